@@ -0,0 +1,163 @@
+package plugin
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"encoding/hex"
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/grafana/grafana-plugin-sdk-go/data"
+	"strconv"
+	"sync"
+	"time"
+)
+
+/*
+	The query cache keeps the decoded exec responses of a datasource instance in
+	memory, so that dashboards refreshed by many screens don't run the same
+	WarpScript again and again. The key is built from the time range rounded
+	down to the cache step, so that refreshes of a relative range ("now-1h" to
+	"now") within the same step share a result, while the executed script keeps
+	the exact range. The key is a hash of the datasource UID, the forwarded
+	Grafana user, the rounded range, the script built over it, header
+	included, and the options the response is decoded with.
+
+	Entries expire after the TTL, and the least recently used one is evicted
+	once the cache is full. Queries with noCache set, live and Mobius queries
+	never use the cache.
+*/
+
+const (
+	// TTL of a cached result when not set
+	defaultCacheTTL = time.Minute
+	// rounding step of the cached time ranges when not set
+	defaultCacheStep = 10 * time.Second
+)
+
+// queryCache is a LRU cache of decoded exec responses with a TTL. A nil queryCache
+// doesn't cache anything.
+type queryCache struct {
+	mu sync.Mutex
+	// UID of the datasource, part of every key
+	uid        string
+	maxEntries int
+	ttl        time.Duration
+	step       time.Duration
+	// most recently used first
+	order   *list.List
+	entries map[string]*list.Element
+}
+
+// cachedResult is a decoded exec response stored in the cache, its frames
+// are shared by the queries served from the cache
+type cachedResult struct {
+	key    string
+	frames data.Frames
+	stats  execStats
+	stored time.Time
+}
+
+// newQueryCache returns nil when maxEntries is not set
+func newQueryCache(uid string, maxEntries int, ttl time.Duration, step time.Duration) *queryCache {
+	if maxEntries <= 0 {
+		return nil
+	}
+	if ttl <= 0 {
+		ttl = defaultCacheTTL
+	}
+	if step <= 0 {
+		step = defaultCacheStep
+	}
+
+	return &queryCache{
+		uid:        uid,
+		maxEntries: maxEntries,
+		ttl:        ttl,
+		step:       step,
+		order:      list.New(),
+		entries:    map[string]*list.Element{},
+	}
+}
+
+// round rounds a time range down to the cache step
+func (c *queryCache) round(timeRange backend.TimeRange) backend.TimeRange {
+	if c == nil {
+		return timeRange
+	}
+
+	return backend.TimeRange{From: timeRange.From.Truncate(c.step), To: timeRange.To.Truncate(c.step)}
+}
+
+// key returns the cache key of a script executed over a time range for a
+// forwarded user, its response being decoded with opts
+func (c *queryCache) key(timeRange backend.TimeRange, script string, opts parseOptions, user string) string {
+	hash := sha256.New()
+	for _, part := range []string{c.uid, user, strconv.FormatInt(timeRange.From.UnixMicro(), 10), strconv.FormatInt(timeRange.To.UnixMicro(), 10), script, opts.key()} {
+		hash.Write([]byte(part))
+		hash.Write([]byte{0})
+	}
+
+	return hex.EncodeToString(hash.Sum(nil))
+}
+
+// get returns the result cached for key, if it has not expired
+func (c *queryCache) get(key string) (*cachedResult, bool) {
+	if c == nil {
+		return nil, false
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	element, ok := c.entries[key]
+	if !ok {
+		return nil, false
+	}
+
+	result := element.Value.(*cachedResult)
+	if time.Since(result.stored) > c.ttl {
+		c.order.Remove(element)
+		delete(c.entries, key)
+		return nil, false
+	}
+
+	c.order.MoveToFront(element)
+	return result, true
+}
+
+// set stores the result of key, evicting the least recently used results
+// above the size limit
+func (c *queryCache) set(key string, frames data.Frames, stats execStats) {
+	if c == nil {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	result := &cachedResult{key: key, frames: frames, stats: stats, stored: time.Now()}
+	if element, ok := c.entries[key]; ok {
+		element.Value = result
+		c.order.MoveToFront(element)
+		return
+	}
+
+	c.entries[key] = c.order.PushFront(result)
+	for c.order.Len() > c.maxEntries {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.entries, oldest.Value.(*cachedResult).key)
+	}
+}
+
+// setCacheHit marks the frames of a result served from the cache
+func setCacheHit(frames data.Frames, stored time.Time) {
+	for _, frame := range frames {
+		if frame.Meta == nil {
+			frame.Meta = &data.FrameMeta{}
+		}
+		custom, _ := frame.Meta.Custom.(FrameMetaCustom)
+		custom.Cached = true
+		custom.CachedAt = &stored
+		frame.Meta.Custom = custom
+	}
+}
@@ -0,0 +1,134 @@
+package plugin
+
+import (
+	"context"
+	"fmt"
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"io"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestQueryCacheLRU(t *testing.T) {
+	c := newQueryCache("uid", 2, time.Minute, time.Second)
+
+	c.set("a", nil, execStats{})
+	c.set("b", nil, execStats{})
+	if _, ok := c.get("a"); !ok {
+		t.Fatal("Expected a to be cached")
+	}
+
+	// b is now the least recently used
+	c.set("c", nil, execStats{})
+	if _, ok := c.get("b"); ok {
+		t.Error("Expected b to be evicted")
+	}
+	for _, key := range []string{"a", "c"} {
+		if _, ok := c.get(key); !ok {
+			t.Errorf("Expected %s to be cached", key)
+		}
+	}
+}
+
+func TestQueryCacheTTL(t *testing.T) {
+	c := newQueryCache("uid", 2, time.Millisecond, time.Second)
+
+	c.set("a", nil, execStats{})
+	time.Sleep(5 * time.Millisecond)
+	if _, ok := c.get("a"); ok {
+		t.Error("Expected a to be expired")
+	}
+	if len(c.entries) != 0 || c.order.Len() != 0 {
+		t.Error("Expected the expired result to be removed")
+	}
+}
+
+func TestQueryCacheKey(t *testing.T) {
+	c := newQueryCache("uid", 2, time.Minute, 10*time.Second)
+	other := newQueryCache("other", 2, time.Minute, 10*time.Second)
+
+	at := func(s int) time.Time { return time.Unix(1700000000+int64(s), 0) }
+	rounded := c.round(backend.TimeRange{From: at(1), To: at(3601)})
+	if !rounded.From.Equal(at(0)) || !rounded.To.Equal(at(3600)) {
+		t.Errorf("Unexpected rounded range %v", rounded)
+	}
+
+	key := c.key(rounded, "NOW", parseOptions{}, "")
+	if key != c.key(c.round(backend.TimeRange{From: at(9), To: at(3609)}), "NOW", parseOptions{}, "") {
+		t.Error("Expected ranges within the same step to share a key")
+	}
+	if key == c.key(c.round(backend.TimeRange{From: at(10), To: at(3610)}), "NOW", parseOptions{}, "") {
+		t.Error("Expected ranges of the next step to have another key")
+	}
+	if key == c.key(rounded, "NOW 1", parseOptions{}, "") || key == other.key(rounded, "NOW", parseOptions{}, "") {
+		t.Error("Expected the script and the datasource to be part of the key")
+	}
+	if key == c.key(rounded, "NOW", parseOptions{hideLabels: true}, "") {
+		t.Error("Expected the parse options to be part of the key")
+	}
+	if key == c.key(rounded, "NOW", parseOptions{}, "alice") {
+		t.Error("Expected the forwarded user to be part of the key")
+	}
+
+	if newQueryCache("uid", 0, time.Minute, time.Second) != nil {
+		t.Error("Expected no cache without size")
+	}
+}
+
+func TestQueryDataCache(t *testing.T) {
+	var execs atomic.Int32
+	var script atomic.Value
+	d := newTestDatasource(t, func(w http.ResponseWriter, r *http.Request) {
+		execs.Add(1)
+		body, _ := io.ReadAll(r.Body)
+		script.Store(string(body))
+		_, _ = w.Write([]byte(`[42]`))
+	})
+	d.cache = newQueryCache("uid", 10, time.Minute, time.Minute)
+
+	now := time.Now().Truncate(time.Minute)
+	query := func(from time.Time, json string) backend.DataResponse {
+		return d.query(context.Background(), backend.PluginContext{}, backend.DataQuery{
+			RefID:     "A",
+			JSON:      []byte(json),
+			TimeRange: backend.TimeRange{From: from, To: from.Add(time.Hour)},
+		})
+	}
+	cached := func(res backend.DataResponse) bool {
+		if res.Error != nil {
+			t.Fatal(res.Error)
+		}
+		custom, _ := res.Frames[0].Meta.Custom.(FrameMetaCustom)
+		return custom.Cached
+	}
+
+	first := query(now.Add(5*time.Second), `{"expr": "42"}`)
+	if cached(first) {
+		t.Error("Expected the first result not to be cached")
+	}
+	if end := now.Add(time.Hour + 5*time.Second).UnixMicro(); !strings.Contains(script.Load().(string), fmt.Sprintf("%d 'end' STORE", end)) {
+		t.Errorf("Expected the script to be executed over the exact range, got %q", script.Load())
+	}
+	if !cached(query(now.Add(30*time.Second), `{"expr": "42"}`)) {
+		t.Error("Expected a refresh within the step to be served from the cache")
+	}
+	if cached(first) {
+		t.Error("Expected the cached frames not to share their metadata with the first result")
+	}
+	if cached(query(now, `{"expr": "42", "hideLabels": true}`)) {
+		t.Error("Expected other parse options not to share the cached frames")
+	}
+	if cached(query(now, `{"expr": "42", "noCache": true}`)) {
+		t.Error("Expected noCache to bypass the cache")
+	}
+	if cached(query(now.Add(time.Minute), `{"expr": "42"}`)) {
+		t.Error("Expected the next step not to be cached")
+	}
+
+	if execs.Load() != 4 {
+		t.Errorf("Expected 4 executions, got %d", execs.Load())
+	}
+}
@@ -0,0 +1,132 @@
+package plugin
+
+import (
+	"context"
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"io"
+	"sync"
+)
+
+/*
+	Identical executions running at the same time on a datasource instance, like
+	a dashboard open in many browsers, are coalesced: the first one runs the
+	script on warp10 and the others wait for its result. The response is
+	decoded once while it's received, and the callers share the decoded result,
+	so the key tells how the response is decoded on top of the script.
+
+	The shared execution is not bound to the context of any caller: each caller
+	stops waiting as soon as its own context is done, and the execution is
+	cancelled only once every caller left. It keeps the values of the first
+	caller context (trace, audit headers), and the datasource query timeout.
+	Only the shared execution waits for the query limiter, so that the callers
+	joining it don't hold a slot each.
+	When the Grafana user is forwarded, executions of different users are never
+	coalesced, so that warp10 sees every user.
+*/
+
+// execGroup coalesces the identical executions in flight. The zero value is
+// ready to use.
+type execGroup struct {
+	mu    sync.Mutex
+	calls map[string]*execCall
+}
+
+// execCall is an execution shared by its waiters
+type execCall struct {
+	// closed once result, stats and err are set
+	done   chan struct{}
+	result interface{}
+	stats  execStats
+	err    error
+	// recovered from fn, panicked again in every waiter
+	panicked interface{}
+
+	waiters int
+	cancel  context.CancelFunc
+}
+
+// do runs fn once for all the callers of the same key in flight. shared is
+// true when the result comes from the execution of another caller.
+func (g *execGroup) do(ctx context.Context, key string, fn func(ctx context.Context) (interface{}, execStats, error)) (result interface{}, stats execStats, shared bool, err error) {
+	g.mu.Lock()
+	if g.calls == nil {
+		g.calls = map[string]*execCall{}
+	}
+
+	call, shared := g.calls[key]
+	if !shared {
+		callCtx, cancel := context.WithCancel(context.WithoutCancel(ctx))
+		call = &execCall{done: make(chan struct{}), cancel: cancel}
+		g.calls[key] = call
+
+		go func() {
+			defer func() {
+				call.panicked = recover()
+				cancel()
+
+				g.mu.Lock()
+				if g.calls[key] == call {
+					delete(g.calls, key)
+				}
+				g.mu.Unlock()
+				close(call.done)
+			}()
+
+			call.result, call.stats, call.err = fn(callCtx)
+		}()
+	}
+	call.waiters++
+	g.mu.Unlock()
+
+	select {
+	case <-call.done:
+		if call.panicked != nil {
+			// the waiters recover it, the plugin must not crash
+			panic(call.panicked)
+		}
+		return call.result, call.stats, shared, call.err
+	case <-ctx.Done():
+		g.mu.Lock()
+		call.waiters--
+		if call.waiters == 0 {
+			// nobody waits for the result anymore
+			call.cancel()
+			if g.calls[key] == call {
+				delete(g.calls, key)
+			}
+		}
+		g.mu.Unlock()
+		return nil, execStats{}, shared, context.Cause(ctx)
+	}
+}
+
+// sharedExec executes a script once allowed by the limiter and returns the
+// result of read on its response, joining the identical execution in flight
+// if any. The result is shared by the callers of the same key, that must not
+// modify it.
+func (d *Datasource) sharedExec(ctx context.Context, pCtx backend.PluginContext, refID string, key string, script string, read func(body io.Reader) interface{}) (interface{}, execStats, error) {
+	if user := d.forwardedUser(pCtx); user != "" {
+		key = user + "\x00" + key
+	}
+
+	result, stats, shared, err := d.execs.do(ctx, key, func(ctx context.Context) (interface{}, execStats, error) {
+		// the time spent queued doesn't count in the query timeout
+		release, err := d.limiter.acquire(ctx, refID)
+		if err != nil {
+			return nil, execStats{}, err
+		}
+		defer release()
+
+		ctx, cancel := d.withQueryTimeout(ctx)
+		defer cancel()
+
+		var result interface{}
+		stats, err := d.exec(ctx, script, func(body io.Reader) { result = read(body) })
+		return result, stats, err
+	})
+	if shared {
+		d.metrics.coalesced()
+	}
+
+	return result, stats, err
+}
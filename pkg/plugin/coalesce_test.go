@@ -0,0 +1,143 @@
+package plugin
+
+import (
+	"context"
+	"errors"
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestQueryDataCoalescing(t *testing.T) {
+	var execs atomic.Int32
+	release := make(chan struct{})
+	d := newTestDatasource(t, func(w http.ResponseWriter, r *http.Request) {
+		execs.Add(1)
+		<-release
+		_, _ = w.Write([]byte(`[42]`))
+	})
+
+	const browsers = 20
+	var wg sync.WaitGroup
+	responses := make([]backend.DataResponse, browsers)
+	for i := 0; i < browsers; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			responses[i] = d.query(context.Background(), backend.PluginContext{}, backend.DataQuery{RefID: "A", JSON: []byte(`{"expr": "42"}`)})
+		}(i)
+	}
+
+	// wait for every query to join the execution in flight
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		d.execs.mu.Lock()
+		waiters := 0
+		for _, call := range d.execs.calls {
+			waiters += call.waiters
+		}
+		d.execs.mu.Unlock()
+		if waiters == browsers {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected %d waiters, got %d", browsers, waiters)
+		}
+		time.Sleep(time.Millisecond)
+	}
+	close(release)
+	wg.Wait()
+
+	if execs.Load() != 1 {
+		t.Errorf("Expected a single execution, got %d", execs.Load())
+	}
+	for i, res := range responses {
+		if res.Error != nil || len(res.Frames) != 1 {
+			t.Errorf("Unexpected response %d: %v", i, res.Error)
+		}
+	}
+	if len(d.execs.calls) != 0 {
+		t.Errorf("Expected no execution left in flight, got %d", len(d.execs.calls))
+	}
+}
+
+func TestExecGroupCancellation(t *testing.T) {
+	var g execGroup
+	started := make(chan struct{})
+	release := make(chan struct{})
+	cancelled := make(chan struct{})
+
+	fn := func(ctx context.Context) (interface{}, execStats, error) {
+		close(started)
+		select {
+		case <-release:
+			return `[1]`, execStats{}, nil
+		case <-ctx.Done():
+			close(cancelled)
+			return nil, execStats{}, ctx.Err()
+		}
+	}
+
+	// the first caller leaves, the second one still gets the result
+	firstCtx, cancelFirst := context.WithCancel(context.Background())
+	firstErr := make(chan error)
+	go func() {
+		_, _, _, err := g.do(firstCtx, "script", fn)
+		firstErr <- err
+	}()
+	<-started
+
+	secondResult := make(chan interface{})
+	go func() {
+		result, _, shared, err := g.do(context.Background(), "script", fn)
+		if err != nil || !shared {
+			t.Errorf("Expected a shared result, got %v", err)
+		}
+		secondResult <- result
+	}()
+	for {
+		g.mu.Lock()
+		waiters := g.calls["script"].waiters
+		g.mu.Unlock()
+		if waiters == 2 {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	cancelFirst()
+	if err := <-firstErr; !errors.Is(err, context.Canceled) {
+		t.Errorf("Expected the first caller to be cancelled, got %v", err)
+	}
+	select {
+	case <-cancelled:
+		t.Fatal("Expected the shared execution to go on for the second caller")
+	default:
+	}
+	close(release)
+	if result := <-secondResult; result != `[1]` {
+		t.Errorf("Unexpected result %v", result)
+	}
+
+	// the execution is cancelled once every caller left
+	started = make(chan struct{})
+	release = make(chan struct{})
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		_, _, _, _ = g.do(ctx, "script", fn)
+	}()
+	<-started
+	cancel()
+	<-done
+
+	select {
+	case <-cancelled:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expected the execution to be cancelled")
+	}
+}
@@ -3,14 +3,17 @@ package plugin
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"github.com/grafana/grafana-plugin-sdk-go/backend"
 	"github.com/grafana/grafana-plugin-sdk-go/backend/instancemgmt"
 	"github.com/grafana/grafana-plugin-sdk-go/backend/log"
 	"github.com/grafana/grafana-plugin-sdk-go/data"
 	b "github.com/miton18/go-warp10/base"
-	"github.com/tidwall/gjson"
-	_ "github.com/tidwall/gjson"
+	"go.opentelemetry.io/otel/trace"
+	"io"
+	"regexp"
+	"runtime/debug"
 	"sort"
 	"strings"
 	"sync"
@@ -25,11 +28,13 @@ import (
 var (
 	_ backend.QueryDataHandler      = (*Datasource)(nil)
 	_ backend.CheckHealthHandler    = (*Datasource)(nil)
+	_ backend.StreamHandler         = (*Datasource)(nil)
+	_ backend.CallResourceHandler   = (*Datasource)(nil)
 	_ instancemgmt.InstanceDisposer = (*Datasource)(nil)
 )
 
 // NewDatasource creates a new datasource instance.
-func NewDatasource(_ context.Context, ds backend.DataSourceInstanceSettings) (instancemgmt.Instance, error) {
+func NewDatasource(ctx context.Context, ds backend.DataSourceInstanceSettings) (instancemgmt.Instance, error) {
 
 	logger := log.New()
 
@@ -39,15 +44,77 @@ func NewDatasource(_ context.Context, ds backend.DataSourceInstanceSettings) (in
 		logger.Error("Unmarshall json data error")
 	}
 
+	if jsonData.TokenVariable == "" {
+		jsonData.TokenVariable = defaultTokenVariable
+	}
+
+	// never log the token, see redact
+	token := ds.DecryptedSecureJSONData[secureTokenKey]
+
+	httpClient, err := newHTTPClient(ctx, ds, jsonData)
+	if err != nil {
+		logger.Error("HTTP client configuration error", "error", err)
+		return nil, err
+	}
+
 	var client *b.Client = b.NewClient(jsonData.Path)
+	client.HTTPClient = httpClient
 
-	return &Datasource{client}, nil
+	mobius, err := newMobiusDialer(ctx, ds, jsonData)
+	if err != nil {
+		// only Mobius queries need it
+		logger.Warn("Mobius configuration error", "error", err)
+	}
+
+	return &Datasource{
+		client:       client,
+		header:       tokenHeader(jsonData.TokenVariable, token) + constantsHeader(jsonData.Const, jsonData.Macro),
+		token:        token,
+		queryTimeout: time.Duration(jsonData.QueryTimeout) * time.Second,
+		maxResponse:  maxResponseBytes(jsonData.MaxResponseSize),
+		limiter:      newQueryLimiter(jsonData.MaxConcurrentQueries, jsonData.RateLimit, jsonData.RateLimitBurst),
+		metrics:      newDatasourceMetrics(ds.UID),
+		cache:        newQueryCache(ds.UID, jsonData.CacheSize, time.Duration(jsonData.CacheTTL)*time.Second, time.Duration(jsonData.CacheStep)*time.Second),
+		mobius:       mobius,
+
+		forwardGrafanaUser: jsonData.ForwardGrafanaUser,
+		attributesPrefix:   jsonData.AttributesPrefix,
+	}, nil
 }
 
 // Datasource is an datasource which can respond to data queries, reports
 // its health and has streaming skills.
 type Datasource struct {
 	client *b.Client
+	// WarpScript storing the secure token, datasource constants and macros, computed once
+	header string
+	// secure token from secureJsonData, must never leave the backend
+	token string
+	// maximum execution time of a single query, 0 means no limit
+	queryTimeout time.Duration
+	// maximum size of an exec response in bytes, 0 means no limit, see
+	// maxResponseBytes
+	maxResponse int64
+	// shared by every QueryData call of this instance, nil means no limit
+	limiter *queryLimiter
+	// prometheus metrics labeled with the datasource UID, nil records nothing
+	metrics *datasourceMetrics
+	// decoded exec responses of the recent queries, nil when the cache is disabled
+	cache *queryCache
+	// identical executions in flight, see sharedExec
+	execs execGroup
+	// last results of the incremental queries
+	incremental incrementalResults
+	// live and Mobius queries, by channel path
+	live liveQueries
+	// opens the Mobius connections, nil when the warp10 URL is invalid
+	mobius *mobiusDialer
+	// Mobius connections shared by the streams
+	mobiusHub mobiusHub
+	// add the audit headers to exec calls, see withAuditHeaders
+	forwardGrafanaUser bool
+	// prefix of the GTS attributes in the field labels
+	attributesPrefix string
 }
 
 // Dispose here tells plugin SDK that plugin wants to clean up resources when a new instance
@@ -56,6 +123,7 @@ type Datasource struct {
 func (d *Datasource) Dispose() {
 	// Clean up datasource instance resources.
 	d.client = nil
+	d.metrics.dispose()
 }
 
 // QueryData handles multiple queries and returns multiple responses.
@@ -63,9 +131,14 @@ func (d *Datasource) Dispose() {
 // The QueryDataResponse contains a map of RefID to the response for each query, and each response
 // contains Frames ([]*Frame).
 func (d *Datasource) QueryData(ctx context.Context, req *backend.QueryDataRequest) (*backend.QueryDataResponse, error) {
+	ctx, span := startSpan(ctx, "QueryData", attributeQueries.Int(len(req.Queries)))
+	defer span.End()
+
 	// create response struct
 	response := backend.NewQueryDataResponse()
 
+	ctx = d.withAuditHeaders(ctx, req.PluginContext, req.GetHTTPHeaders())
+
 	// Use WaitGroup to handle parallel execution
 	var wg sync.WaitGroup
 	var mu sync.Mutex
@@ -77,7 +150,7 @@ func (d *Datasource) QueryData(ctx context.Context, req *backend.QueryDataReques
 		go func(query backend.DataQuery) {
 			defer wg.Done()
 
-			res := d.query(ctx, req.PluginContext, query)
+			res := d.runQuery(ctx, req.PluginContext, query)
 
 			// Safely update the response map
 			// based on with RefID as identifier
@@ -92,7 +165,26 @@ func (d *Datasource) QueryData(ctx context.Context, req *backend.QueryDataReques
 	return response, nil
 }
 
-func (d *Datasource) query(_ context.Context, pCtx backend.PluginContext, query backend.DataQuery) backend.DataResponse {
+// runQuery runs the query, its execution waiting for the limiter. A panic is turned into an
+// error response of this query only, so that it can't take down the plugin.
+func (d *Datasource) runQuery(ctx context.Context, pCtx backend.PluginContext, query backend.DataQuery) (res backend.DataResponse) {
+	ctx, span := startSpan(ctx, "query", attributeRefID.String(query.RefID))
+
+	finished := func(backend.DataResponse) {}
+	defer func() {
+		if r := recover(); r != nil {
+			log.New().Error("Query panicked", "refId", query.RefID, "panic", r, "stack", string(debug.Stack()))
+			res = backend.ErrDataResponse(backend.StatusInternal, fmt.Sprintf("query panicked: %v", r))
+		}
+		finished(res)
+		endQuerySpan(span, res)
+	}()
+
+	finished = d.metrics.queryStarted()
+	return d.query(ctx, pCtx, query)
+}
+
+func (d *Datasource) query(ctx context.Context, pCtx backend.PluginContext, query backend.DataQuery) backend.DataResponse {
 	logger := log.New()
 
 	// Recup warpscript text
@@ -103,64 +195,147 @@ func (d *Datasource) query(_ context.Context, pCtx backend.PluginContext, query
 		return backend.ErrDataResponse(backend.StatusBadRequest, errStr)
 	}
 
-	// Exec query
-	body, err := d.client.Exec(wsQuery.Expr)
-	if err != nil {
-		var errStr = fmt.Sprintf("client exec: %v", err.Error())
-		logger.Error(errStr)
-		return backend.ErrDataResponse(backend.StatusInternal, errStr)
+	// streamed queries must see every new datapoint
+	streamed := wsQuery.Live || wsQuery.Mobius
+	useCache := d.cache != nil && !wsQuery.NoCache && !wsQuery.Incremental && !streamed
+
+	script := d.buildScript(query, wsQuery)
+	var incremental *incrementalRun
+	if wsQuery.Incremental && !streamed {
+		var err error
+		if incremental, script, err = d.startIncremental(pCtx, query, wsQuery); err != nil {
+			return backend.ErrDataResponse(backend.StatusInternal, err.Error())
+		}
+	}
+	trace.SpanFromContext(ctx).SetAttributes(attributeScriptLength.Int(len(script)))
+
+	opts := parseOptions{
+		hideLabels:       wsQuery.HideLabels,
+		legendFormat:     wsQuery.LegendFormat,
+		attributesPrefix: d.attributesPrefix,
+		geoPoints:        wsQuery.GeoPoints,
+		metrics:          d.metrics,
 	}
 
-	/*
-		Supported reponse types are:
-		- Array of String,Int64,Float64
-		- String, Int64, Float64 element
-		- Array of GTS: [ {...}, {...}, ... ]
-		- Array of array GTS: [ [{...}, {...}, ...] ]
-		- Table: [{ columns: [...], rows: [...] }]
-		- Nested List: [  [ {...}, {...}, ... ], {...}, ... ]
-	*/
+	var cacheKey string
+	var cached *cachedResult
+	if useCache {
+		// refreshes within a cache step share the result executed over the
+		// first exact range
+		rounded := query
+		rounded.TimeRange = d.cache.round(query.TimeRange)
+		cacheKey = d.cache.key(rounded.TimeRange, d.buildScript(rounded, wsQuery), opts, d.forwardedUser(pCtx))
+		cached, _ = d.cache.get(cacheKey)
+		d.metrics.cacheLookup(cached != nil)
+	}
 
-	// If the response is a table...
-	backendTableResult, err := parseTableResult(body)
-	if err == nil {
-		return backendTableResult
+	// the frames of the cache and of the coalesced executions are shared, the
+	// response gets copies with their own metadata
+	var res backend.DataResponse
+	var stats execStats
+	if cached != nil {
+		res.Frames, stats = responseFrames(cached.frames), cached.stats
+	} else {
+		result, execStats, err := d.sharedExec(ctx, pCtx, query.RefID, script+"\x00"+opts.key(), script, func(body io.Reader) interface{} {
+			res, err := decodeStack(ctx, body, opts)
+			return decodedStack{frames: res.Frames, err: err}
+		})
+		if err != nil {
+			return d.execFailure(query, wsQuery.HeaderLines, err)
+		}
+		decoded := result.(decodedStack)
+		if decoded.err != nil {
+			logger.Error(decoded.err.Error())
+			return backend.DataResponse{Error: decoded.err}
+		}
+		if useCache {
+			d.cache.set(cacheKey, decoded.frames, execStats)
+		}
+		res.Frames, stats = responseFrames(decoded.frames), execStats
 	}
 
-	// If the result is an array made of GTS or GTSList
-	gtsListResult, err := parseGTSListResult(body, wsQuery.HideLabels)
-	if err == nil {
-		return gtsListResult
+	if incremental != nil {
+		var merged bool
+		if res, merged = d.incrementalResponse(incremental, query.TimeRange, res); !merged {
+			// the previous result is forgotten, the whole range is fetched
+			return d.query(ctx, pCtx, query)
+		}
 	}
 
-	// if response is an array
-	backendArrayResult, err := parseArrayResult(body)
-	if err == nil {
-		return backendArrayResult
+	logger.Debug("Query executed", "refId", query.RefID, "elapsed", stats.Elapsed, "ops", stats.Ops, "fetched", stats.Fetched)
+	setQueryStats(res.Frames, queryStats(stats, len(script), len(res.Frames)))
+	if cached != nil {
+		setCacheHit(res.Frames, cached.stored)
 	}
 
-	// all others warp10 response
-	backendScalarResult, err := parseScalarResult(body)
-	if err == nil {
-		return backendScalarResult
+	if streamed {
+		if err := d.setLiveChannel(pCtx, query, wsQuery, &res); err != nil {
+			logger.Warn("Live query not streamed", "refId", query.RefID, "error", err)
+		}
 	}
 
-	return backend.DataResponse{Error: fmt.Errorf("no supported response type found")}
+	return res
+}
+
+// execFailure turns an exec error into the error response of a query,
+// headerLines being the number of lines prepended to the query by the frontend
+func (d *Datasource) execFailure(query backend.DataQuery, headerLines int, err error) backend.DataResponse {
+	logger := log.New()
+
+	var timeout *queryTimeoutError
+	if errors.As(err, &timeout) {
+		var errStr = fmt.Sprintf("client exec: %v", timeout)
+		logger.Warn(errStr, "refId", query.RefID)
+		return backend.ErrDataResponse(backend.StatusTimeout, errStr)
+	}
+	if errors.Is(err, context.Canceled) {
+		// the query was cancelled by its caller, maybe while queued
+		return backend.DataResponse{Error: err}
+	}
+	if errors.Is(err, context.DeadlineExceeded) {
+		// the deadline of the Grafana request came first, maybe while queued
+		var errStr = "client exec: Grafana request deadline exceeded"
+		logger.Warn(errStr, "refId", query.RefID)
+		return backend.ErrDataResponse(backend.StatusTimeout, errStr)
+	}
+	var tooLarge *responseTooLargeError
+	if errors.As(err, &tooLarge) {
+		var errStr = tooLarge.Error()
+		logger.Warn(errStr, "refId", query.RefID)
+		return backend.ErrDataResponse(backend.StatusBadRequest, errStr)
+	}
+	var execErr *execError
+	if errors.As(err, &execErr) {
+		// report the line as seen in the query editor, below the backend and
+		// frontend headers
+		execErr.shiftLine(strings.Count(d.prelude(query), "\n") + headerLines)
+		var errStr = d.redact(execErr.Error())
+		logger.Warn(errStr, "refId", query.RefID, "line", execErr.Line)
+		return backend.ErrDataResponse(execErr.status(), errStr)
+	}
+
+	var errStr = d.redact(fmt.Sprintf("client exec: %v", err.Error()))
+	logger.Error(errStr)
+	return backend.ErrDataResponse(backend.StatusInternal, errStr)
 }
 
 // CheckHealth handles health checks sent from Grafana to the plugin.
 // The main use case for these health checks is the test button on the
 // datasource configuration page which allows users to verify that
 // a datasource is working as expected.
-func (d *Datasource) CheckHealth(_ context.Context, req *backend.CheckHealthRequest) (*backend.CheckHealthResult, error) {
+func (d *Datasource) CheckHealth(ctx context.Context, req *backend.CheckHealthRequest) (*backend.CheckHealthResult, error) {
 	var status = backend.HealthStatusOk
 	var message = "Data source is working !"
 
-	_, err := d.client.Exec("1 2 +")
+	ctx, cancel := d.withQueryTimeout(d.withAuditHeaders(ctx, req.PluginContext, req.GetHTTPHeaders()))
+	defer cancel()
+
+	_, err := d.exec(ctx, "1 2 +", discardBody)
 
 	if err != nil {
 		status = backend.HealthStatusError
-		message = err.Error()
+		message = d.redact(err.Error())
+		d.metrics.healthCheckFailed()
 	}
 
 	return &backend.CheckHealthResult{
@@ -175,221 +350,423 @@ func timeFromFloat64(t float64) time.Time {
 	return time.UnixMicro(int64(t))
 }
 
-func parseTableResult(result []byte) (backend.DataResponse, error) {
-	var tableResults []TableResult
-	if errRes := json.Unmarshal(result, &tableResults); errRes != nil {
-		errMsg := fmt.Errorf("table parsing error")
-		return backend.DataResponse{}, errMsg
+// gtsTimestamp reads the timestamp of a GTS datapoint, decoded as a json.Number
+func gtsTimestamp(value interface{}) (time.Time, bool) {
+	switch epoch := value.(type) {
+	case json.Number:
+		if us, err := epoch.Int64(); err == nil {
+			return time.UnixMicro(us), true
+		}
+		if us, err := epoch.Float64(); err == nil {
+			return timeFromFloat64(us), true
+		}
+	case float64:
+		return timeFromFloat64(epoch), true
 	}
 
-	if len(tableResults) > 0 && tableResults[0].Columns != nil && tableResults[0].Rows != nil {
-		var frames = make(data.Frames, 1)
-
-		var fields []*data.Field
-		for i, col := range tableResults[0].Columns {
+	return time.Time{}, false
+}
 
-			var r []interface{}
-			// Collect data for the current column
-			for _, row := range tableResults[0].Rows {
-				if i >= len(row) {
-					r = append(r, nil)
-				} else {
-					r = append(r, row[i])
-				}
-			}
+// tableToFrame converts a table to a frame, named from the table name or title
+func tableToFrame(table TableResult) (*data.Frame, error) {
+	var fields []*data.Field
+	for i, col := range table.Columns {
 
-			if field, err := convertListToField(r, col.Text); err != nil {
-				return backend.DataResponse{}, fmt.Errorf("table parsing error: %v", err)
+		var r []interface{}
+		// Collect data for the current column
+		for _, row := range table.Rows {
+			if i >= len(row) {
+				r = append(r, nil)
 			} else {
-				fields = append(fields, field)
+				r = append(r, row[i])
 			}
 		}
 
-		frames[0] = data.NewFrame("tableResults", fields...)
-		return backend.DataResponse{Frames: frames}, nil
+		field, err := convertListToField(r, col.Text)
+		if err != nil {
+			return nil, err
+		}
+		fields = append(fields, field)
 	}
 
-	return backend.DataResponse{}, fmt.Errorf("Table parsing error")
-}
-
-func parseGTSListResult(result []byte, options ...bool) (backend.DataResponse, error) {
-	// manage default parameters
-	hideLabels := false
-	if len(options) > 0 {
-		hideLabels = options[0]
+	name := "tableResults"
+	if table.Name != "" {
+		name = table.Name
+	} else if table.Title != "" {
+		name = table.Title
 	}
 
+	return data.NewFrame(name, fields...), nil
+}
+
+// gtsToFrame converts a GTS to a time series frame. A panic is turned into an
+// error, logged with the shape of the GTS and of the datapoint being converted.
+func gtsToFrame(gts *b.GTS, opts parseOptions) (frame *data.Frame, err error) {
 	logger := log.New()
 
-	var gtsList = b.GTSList{}
-	flattenResult := gjson.GetBytes(result, "@flatten")
-	var raw []byte
-	if flattenResult.Index > 0 {
-		raw = result[flattenResult.Index : flattenResult.Index+len(flattenResult.Raw)]
-	} else {
-		raw = []byte(flattenResult.Raw)
+	// datapoint being converted, logged on panic
+	var current []interface{}
+	defer func() {
+		if r := recover(); r != nil {
+			logger.Error("GTS parsing panicked", "panic", r, "gts", gtsShape(gts), "datapoint", datapointShape(current), "stack", string(debug.Stack()))
+			frame, err = nil, fmt.Errorf("GTSList parsing error: %v", r)
+		}
+	}()
+
+	// The columns are allocated once with a row per datapoint, the first pass
+	// fills the times and locations and finds the type of the values, the
+	// second one fills the values. They are resliced to the rows kept.
+	var size = len(gts.Values)
+	var rows, skipped int
+	var vTimes = make([]time.Time, size)
+	var valuesType = gtsDouble
+
+	// Location of the datapoints, nil when a datapoint has none. The columns
+	// are only allocated once a datapoint is located, the pointers point to
+	// the locations backing array.
+	var vLatitude, vLongitude, vElevation []*float64
+	var locations, elevations []float64
+	var pointList = opts.geoPoints && hasLocation(gts)
+
+	// datapoints not kept, only allocated once one is dropped
+	var dropped []bool
+	drop := func(i int) {
+		if dropped == nil {
+			dropped = make([]bool, size)
+		}
+		dropped[i] = true
 	}
 
-	if err := json.Unmarshal([]byte(raw), &gtsList); err != nil {
-		var errStr = fmt.Sprintf("json unmarshal: %v, gtslist %v", err.Error(), gtsList)
-		logger.Debug("Flatten error", errStr)
-	} else {
-		//Frames creation
-		var frames = make(data.Frames, len(gtsList))
-		var wg sync.WaitGroup
-		var mu sync.Mutex
-
-		for idx, gts := range gtsList {
-			wg.Add(1)
-
-			idx := idx
-			go func(gts *b.GTS) {
-				defer wg.Done()
-
-				//Data tab creation
-				var vTimes = make([]time.Time, len(gts.Values))
-				var vValueFloat []float64
-				var vValueString []string
-				var vValueInt []int64
-
-				//Data type check ( 0 - float / 1 - string / 2 - int )
-				t := 0
-				for _, values := range gts.Values {
-					switch values[len(values)-1].(type) {
-					case string:
-						t = 1
-					case int:
-						if t != 1 {
-							t = 2
-						}
-					}
-				}
+	for i, values := range gts.Values {
+		current = values
+		if len(values) < 2 {
+			logger.Error(fmt.Sprintf("datapoint read: %v", values))
+			skipped++
+			drop(i)
+			continue
+		}
 
-				//Add data to tab
-				for i, values := range gts.Values {
-					switch epoch := values[0].(type) {
-					case float64:
-						vTimes[i] = timeFromFloat64(epoch)
-						if t == 0 {
-							vValueFloat = append(vValueFloat, values[len(values)-1].(float64))
-						} else if t == 1 {
-							vValueString = append(vValueString, values[len(values)-1].(string))
-						} else {
-							vValueInt = append(vValueInt, values[len(values)-1].(int64))
-						}
-					default:
-						var errStr = fmt.Sprintf("epoch read: %v", epoch)
-						logger.Error(errStr)
-					}
-				}
+		lat, lon, elev, located, elevated := gtsLocationValues(values)
+		if pointList && !located {
+			drop(i)
+			continue
+		}
 
-				// Manages name and labels
-				var returnedName = gts.ClassName
-				if !hideLabels {
-					returnedName = nameWithLabels(*gts)
-				}
+		ts, ok := gtsTimestamp(values[0])
+		if !ok {
+			var errStr = fmt.Sprintf("epoch read: %v", values[0])
+			logger.Error(errStr)
+			skipped++
+			drop(i)
+			continue
+		}
 
-				//Fields creation
-				var fieldValue *data.Field
-				if t == 0 {
-					fieldValue = data.NewField(returnedName, nil, vValueFloat)
-				} else if t == 1 {
-					fieldValue = data.NewField(returnedName, nil, vValueString)
-				} else {
-					fieldValue = data.NewField(returnedName, nil, vValueInt)
-				}
+		if located {
+			if locations == nil {
+				vLatitude, vLongitude = make([]*float64, size), make([]*float64, size)
+				locations = make([]float64, 2*size)
+			}
+			locations[2*rows], locations[2*rows+1] = lat, lon
+			vLatitude[rows], vLongitude[rows] = &locations[2*rows], &locations[2*rows+1]
+		}
+		if elevated {
+			if elevations == nil {
+				vElevation = make([]*float64, size)
+				elevations = make([]float64, size)
+			}
+			elevations[rows] = elev
+			vElevation[rows] = &elevations[rows]
+		}
 
-				// add the field to the response.
-				mu.Lock()
-				frames[idx] = data.NewFrame("",
-					data.NewField("time", nil, vTimes),
-					fieldValue,
-				)
-				mu.Unlock()
-			}(gts)
+		vt, ok := valueType(values[len(values)-1])
+		if !ok {
+			// a value out of the float64 range, or not a scalar
+			logger.Error(fmt.Sprintf("value read: %v", values[len(values)-1]))
+			skipped++
+			drop(i)
+			continue
 		}
+		if rows == 0 {
+			valuesType = vt
+		} else {
+			valuesType = mergeTypes(valuesType, vt)
+		}
+		vTimes[rows] = ts
+		rows++
+	}
+
+	column := newValueColumn(valuesType, rows)
+	row := 0
+	for i, values := range gts.Values {
+		if dropped != nil && dropped[i] {
+			continue
+		}
+		current = values
+		column.set(row, values[len(values)-1])
+		row++
+	}
+
+	// Manages name and labels: labels are always sent to Grafana,
+	// hideLabels and legendFormat only change the displayed name
+	var returnedName = gts.ClassName
+	if opts.legendFormat != "" {
+		returnedName = formatLegend(opts.legendFormat, *gts)
+	} else if !opts.hideLabels {
+		returnedName = nameWithLabels(*gts)
+	}
+	labels := gtsLabels(*gts, opts.attributesPrefix)
+
+	//Fields creation
+	fieldValue := data.NewField(gts.ClassName, labels, column.vector())
+	fieldValue.Config = &data.FieldConfig{DisplayNameFromDS: returnedName}
+
+	// add the field to the response.
+	frame = data.NewFrame("",
+		data.NewField("time", nil, vTimes[:rows]),
+		fieldValue,
+	)
+	if vLatitude != nil {
+		frame.Fields = append(frame.Fields,
+			data.NewField("latitude", nil, vLatitude[:rows]),
+			data.NewField("longitude", nil, vLongitude[:rows]),
+		)
+	}
+	if vElevation != nil {
+		frame.Fields = append(frame.Fields, data.NewField("elevation", nil, vElevation[:rows]))
+	}
+	if pointList {
+		// point list of a geo series, named so that a Geomap layer can pick it
+		frame.Name = returnedName
+	}
+	// the attributes and the display name of a series may change between
+	// executions, not its class and labels
+	frame.SetMeta(&data.FrameMeta{Custom: FrameMetaCustom{Series: gts.ClassName + data.Labels(gts.Labels).String()}})
+	if skipped > 0 {
+		frame.AppendNotices(data.Notice{
+			Severity: data.NoticeSeverityWarning,
+			Text:     fmt.Sprintf("%s: %d invalid datapoints ignored", returnedName, skipped),
+		})
+	}
 
-		wg.Wait()
+	return frame, nil
+}
 
-		return backend.DataResponse{Frames: frames}, nil
+// gtsShape describes a GTS for the logs, without its values
+func gtsShape(gts *b.GTS) string {
+	if gts == nil {
+		return "null"
 	}
 
-	return backend.DataResponse{}, fmt.Errorf("GTSList parsing error")
+	return fmt.Sprintf("%s (%d datapoints)", gts.SensisionSelector(false), len(gts.Values))
 }
 
-func parseArrayResult(result []byte) (backend.DataResponse, error) {
-	logger := log.New()
+// datapointShape describes the types of a datapoint for the logs, e.g. [json.Number string]
+func datapointShape(values []interface{}) string {
+	types := make([]string, len(values))
+	for i, value := range values {
+		types[i] = fmt.Sprintf("%T", value)
+	}
 
-	var warp10ArrayResult [][]interface{}
-	if err := json.Unmarshal(result, &warp10ArrayResult); err != nil {
-		logger.Debug("Array parsing error ", warp10ArrayResult)
-	} else {
-		logger.Debug("Array results parsing error ", warp10ArrayResult)
+	return fmt.Sprintf("%v", types)
+}
 
-		// warp10 response is always an array
-		if len(warp10ArrayResult) == 0 {
-			return backend.DataResponse{}, fmt.Errorf("array parsing error. Response unmarshal but warp10 array is empty")
+// gtsLocationValues reads the optional location of a GTS datapoint, warp10
+// encodes datapoints as [ts, value], [ts, elev, value], [ts, lat, lon, value]
+// or [ts, lat, lon, elev, value]
+func gtsLocationValues(values []interface{}) (lat, lon, elev float64, located, elevated bool) {
+	var hasLat, hasLon bool
+	switch len(values) {
+	case 3:
+		elev, elevated = float64Value(values[1])
+	case 4:
+		lat, hasLat = float64Value(values[1])
+		lon, hasLon = float64Value(values[2])
+	case 5:
+		lat, hasLat = float64Value(values[1])
+		lon, hasLon = float64Value(values[2])
+		elev, elevated = float64Value(values[3])
+	}
+
+	if !hasLat || !hasLon {
+		return 0, 0, elev, false, elevated
+	}
+
+	return lat, lon, elev, true, elevated
+}
+
+// hasLocation returns whether at least one datapoint of the GTS is located
+func hasLocation(gts *b.GTS) bool {
+	for _, values := range gts.Values {
+		if _, _, _, located, _ := gtsLocationValues(values); located {
+			return true
 		}
-		var arrayRes = warp10ArrayResult[0]
+	}
 
-		var fields []*data.Field
-		if field, err := convertListToField(arrayRes, "array_value"); err != nil {
-			return backend.DataResponse{}, fmt.Errorf("array parsing error: %v", err)
-		} else {
-			fields = append(fields, field)
+	return false
+}
+
+func float64Value(value interface{}) (float64, bool) {
+	switch v := value.(type) {
+	case float64:
+		return v, true
+	case json.Number:
+		if f, err := v.Float64(); err == nil {
+			return f, true
 		}
+	}
+
+	return 0, false
+}
 
-		var frames = make(data.Frames, 1)
-		frames[0] = data.NewFrame("arrayResults", fields...)
-		return backend.DataResponse{Frames: frames}, nil
+/*
+	Warp10 GTS values are DOUBLE, LONG, STRING or BOOLEAN. A GTS holding several
+	types (e.g. built with a MAP on mixed data) is typed this way:
+	- LONG and DOUBLE values only: DOUBLE
+	- any other mix: STRING, with every value formatted as in the warp10 response
+	Datapoints whose value can't be converted (a number out of the float64
+	range, a map or a list) are ignored, and counted in the notice of the frame.
+*/
+
+// gtsType is the field type of the values of a GTS
+type gtsType int
+
+const (
+	gtsDouble gtsType = iota
+	gtsLong
+	gtsString
+	gtsBoolean
+)
+
+// valueType returns the warp10 type of a single GTS value, decoded with
+// UseNumber. ok is false when the value can't be converted: a number out of
+// the float64 range, a map or a list.
+func valueType(value interface{}) (t gtsType, ok bool) {
+	switch v := value.(type) {
+	case json.Number:
+		if _, err := v.Int64(); err == nil && !strings.ContainsAny(v.String(), ".eE") {
+			return gtsLong, true
+		}
+		_, ok := float64Value(v)
+		return gtsDouble, ok
+	case float64:
+		return gtsDouble, true
+	case bool:
+		return gtsBoolean, true
+	case map[string]interface{}, []interface{}:
+		return gtsString, false
+	default:
+		return gtsString, true
 	}
+}
 
-	return backend.DataResponse{}, fmt.Errorf("array parsing error")
+// mergeTypes returns the type of the field holding values of types t and vt
+func mergeTypes(t gtsType, vt gtsType) gtsType {
+	switch {
+	case vt == t:
+		return t
+	case (vt == gtsDouble || vt == gtsLong) && (t == gtsDouble || t == gtsLong):
+		return gtsDouble
+	default:
+		return gtsString
+	}
 }
 
-func parseScalarResult(result []byte) (backend.DataResponse, error) {
-	logger := log.New()
+// valueColumn is the vector of the values of a GTS, allocated for its type
+// and number of rows
+type valueColumn struct {
+	t       gtsType
+	doubles []float64
+	longs   []int64
+	strings []string
+	bools   []bool
+}
 
-	var warp10ScalarResult []interface{}
-	if err := json.Unmarshal(result, &warp10ScalarResult); err != nil {
-		logger.Debug("Scalar parsing error", warp10ScalarResult)
-	} else {
-		logger.Debug("warp10ScalarResult", warp10ScalarResult)
+func newValueColumn(t gtsType, rows int) *valueColumn {
+	c := &valueColumn{t: t}
+	switch t {
+	case gtsLong:
+		c.longs = make([]int64, rows)
+	case gtsBoolean:
+		c.bools = make([]bool, rows)
+	case gtsString:
+		c.strings = make([]string, rows)
+	default:
+		c.doubles = make([]float64, rows)
+	}
 
-		// warp10 response is always an array
-		if len(warp10ScalarResult) == 0 {
-			return backend.DataResponse{}, fmt.Errorf("scalar parsing error. Response unmarshal but warp10 array is empty")
-		}
-		var scalarRes = warp10ScalarResult[0]
-
-		var fields []*data.Field
-
-		switch v := scalarRes.(type) {
-		case string:
-			field := data.NewField("scalar_value_string", nil, []string{v})
-			fields = append(fields, field)
-		case int64:
-			field := data.NewField("scalar_value_int64", nil, []int64{v})
-			fields = append(fields, field)
-		case float64:
-			field := data.NewField("scalar_value_float64", nil, []float64{v})
-			fields = append(fields, field)
-		case bool:
-			field := data.NewField("scalar_value_bool", nil, []bool{v})
-			fields = append(fields, field)
-		default:
-			logger.Debug("No response type found: warp10 result:", warp10ScalarResult)
-			return backend.DataResponse{Error: fmt.Errorf("no response type found")}, nil
-		}
+	return c
+}
 
-		logger.Debug("Sent scalar dataframe in response")
+// set converts a value to the type of the column, see mergeTypes. The value
+// must have been checked by valueType.
+func (c *valueColumn) set(row int, value interface{}) {
+	switch c.t {
+	case gtsLong:
+		c.longs[row], _ = value.(json.Number).Int64()
+	case gtsBoolean:
+		c.bools[row] = value.(bool)
+	case gtsString:
+		c.strings[row] = formatValue(value)
+	default:
+		c.doubles[row], _ = float64Value(value)
+	}
+}
 
-		var frames = make(data.Frames, 1)
-		frames[0] = data.NewFrame("scalarResult", fields...)
-		return backend.DataResponse{Frames: frames}, nil
+// vector returns the vector of a field holding the column
+func (c *valueColumn) vector() interface{} {
+	switch c.t {
+	case gtsLong:
+		return c.longs
+	case gtsBoolean:
+		return c.bools
+	case gtsString:
+		return c.strings
+	default:
+		return c.doubles
 	}
+}
 
-	return backend.DataResponse{}, fmt.Errorf("Scalar parsing error")
+// formatValue returns a GTS value as a string
+func formatValue(value interface{}) string {
+	switch v := value.(type) {
+	case string:
+		return v
+	case json.Number:
+		return v.String()
+	case nil:
+		return ""
+	default:
+		return fmt.Sprint(v)
+	}
+}
+
+// arrayFrame converts a list of values to a frame, see convertListToField
+func arrayFrame(values []interface{}) (*data.Frame, error) {
+	field, err := convertListToField(values, "array_value")
+	if err != nil {
+		return nil, fmt.Errorf("array parsing error: %v", err)
+	}
+
+	return data.NewFrame("arrayResults", field), nil
+}
+
+// scalarFrame converts a string, number or boolean to a single value frame
+func scalarFrame(value interface{}) (*data.Frame, error) {
+	var field *data.Field
+	switch v := value.(type) {
+	case string:
+		field = data.NewField("scalar_value_string", nil, []string{v})
+	case int64:
+		field = data.NewField("scalar_value_int64", nil, []int64{v})
+	case float64:
+		field = data.NewField("scalar_value_float64", nil, []float64{v})
+	case bool:
+		field = data.NewField("scalar_value_bool", nil, []bool{v})
+	default:
+		return nil, fmt.Errorf("no response type found")
+	}
+
+	return data.NewFrame("scalarResult", field), nil
 }
 
 func convertListToField(values []interface{}, className string) (*data.Field, error) {
@@ -468,6 +845,39 @@ func convertListToField(values []interface{}, className string) (*data.Field, er
 
 	return field, nil
 }
+
+// gtsLabels returns the GTS labels, and its attributes with their name
+// prefixed. A label wins over an attribute with the same name.
+func gtsLabels(gts b.GTS, attributesPrefix string) data.Labels {
+	if len(gts.Labels) == 0 && len(gts.Attributes) == 0 {
+		return nil
+	}
+
+	labels := make(data.Labels, len(gts.Labels)+len(gts.Attributes))
+	for key, value := range gts.Attributes {
+		labels[attributesPrefix+key] = value
+	}
+	for key, value := range gts.Labels {
+		labels[key] = value
+	}
+	return labels
+}
+
+// legendFormatRegexp matches the {{label}} placeholders of a legend format
+var legendFormatRegexp = regexp.MustCompile(`\{\{\s*([^{}\s]+)\s*\}\}`)
+
+// formatLegend replaces {{label}} by the GTS label value, and {{__name__}} by
+// the class name. Unknown labels are replaced by an empty string.
+func formatLegend(legendFormat string, gts b.GTS) string {
+	return legendFormatRegexp.ReplaceAllStringFunc(legendFormat, func(placeholder string) string {
+		key := legendFormatRegexp.FindStringSubmatch(placeholder)[1]
+		if key == "__name__" {
+			return gts.ClassName
+		}
+		return gts.Labels[key]
+	})
+}
+
 func nameWithLabels(gts b.GTS) string {
 	var keyValues []string
 	for key, value := range gts.Labels {
@@ -4,8 +4,14 @@ import (
 	"context"
 	"encoding/json"
 	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/grafana/grafana-plugin-sdk-go/data"
 	b "github.com/miton18/go-warp10/base"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
 	"testing"
+	"time"
 )
 
 func TestQueryData(t *testing.T) {
@@ -28,7 +34,58 @@ func TestQueryData(t *testing.T) {
 	}
 }
 
-func TestParseTableResult(t *testing.T) {
+func TestQueryDataPanic(t *testing.T) {
+	// without client, the exec call panics
+	ds := Datasource{}
+
+	resp, err := ds.QueryData(
+		context.Background(),
+		&backend.QueryDataRequest{
+			Queries: []backend.DataQuery{
+				{RefID: "A", JSON: []byte(`{"expr": "1"}`)},
+				{RefID: "B"},
+			},
+		},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if res := resp.Responses["A"]; res.Status != backend.StatusInternal || res.Error == nil {
+		t.Errorf("Expected panicking query to fail with status %v, got %v (%v)", backend.StatusInternal, res.Status, res.Error)
+	}
+	if res := resp.Responses["B"]; res.Status != backend.StatusBadRequest {
+		t.Errorf("Expected other query to keep its own status %v, got %v", backend.StatusBadRequest, res.Status)
+	}
+}
+
+func TestDecodeStackGTSInvalid(t *testing.T) {
+	if _, err := decodeString(`[[null, {"c": "testClass", "v": [[1, 2]]}]]`, parseOptions{}); err == nil {
+		t.Error("Expected a null GTS to fail")
+	}
+
+	resp, err := decodeString(`[{"c": "testClass", "l": {}, "a": {}, "v": [[], [1619784000000000], [1619784001000000, 42]]}]`, parseOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Frames[0].Rows() != 1 || len(resp.Frames[0].Meta.Notices) != 1 {
+		t.Errorf("Expected invalid datapoints to be ignored with a notice, got %d rows", resp.Frames[0].Rows())
+	}
+
+	resp, err = decodeString(`[{"c": "testClass", "l": {}, "a": {}, "v": [[1619784000000000, 1e400], [1619784001000000, {"x": 1}], [1619784002000000, 42.5]]}]`, parseOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	field := resp.Frames[0].Fields[1]
+	if resp.Frames[0].Rows() != 1 || field.Type() != data.FieldTypeFloat64 || field.At(0) != 42.5 {
+		t.Errorf("Expected unconvertible values to be ignored, got %d %s rows", resp.Frames[0].Rows(), field.Type())
+	}
+	if notices := resp.Frames[0].Meta.Notices; len(notices) != 1 || !strings.Contains(notices[0].Text, "2 invalid datapoints") {
+		t.Errorf("Expected a notice of the ignored values, got %v", notices)
+	}
+}
+
+func TestDecodeStackTable(t *testing.T) {
 	tableResult := `[{
 		"columns": [
 			{
@@ -48,8 +105,7 @@ func TestParseTableResult(t *testing.T) {
 		]
 	}]`
 
-	tableResultB := []byte(tableResult)
-	resp, err := parseTableResult(tableResultB)
+	resp, err := decodeString(tableResult, parseOptions{})
 	if err != nil {
 		t.Error(err)
 	}
@@ -78,7 +134,127 @@ func TestParseTableResult(t *testing.T) {
 	}
 }
 
-func TestParseGTSListResult(t *testing.T) {
+func TestDecodeStackMultipleTables(t *testing.T) {
+	tableResult := `[
+		{
+			"name": "summary",
+			"columns": [{ "text": "total", "type": "number" }],
+			"rows": [[42]]
+		},
+		{
+			"title": "detail",
+			"columns": [{ "text": "host", "type": "string" }, { "text": "value", "type": "number" }],
+			"rows": [["a", 20], ["b", 22]]
+		},
+		{
+			"columns": [{ "text": "columnA", "type": "number" }],
+			"rows": [[1]]
+		}
+	]`
+
+	resp, err := decodeString(tableResult, parseOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expectedNames := []string{"summary", "detail", "tableResults"}
+	if len(resp.Frames) != len(expectedNames) {
+		t.Fatalf("Expected %d frames in response, got %d", len(expectedNames), len(resp.Frames))
+	}
+
+	for i, name := range expectedNames {
+		if resp.Frames[i].Name != name {
+			t.Errorf("Expected frame %d name to be '%s', got %s", i, name, resp.Frames[i].Name)
+		}
+	}
+
+	if resp.Frames[1].Rows() != 2 || len(resp.Frames[1].Fields) != 2 {
+		t.Errorf("Expected detail frame to have 2 fields and 2 rows")
+	}
+}
+
+func TestDecodeStackTableNextToGTS(t *testing.T) {
+	mixedResult := `[
+		[{ "c": "testClass", "l": {}, "a": {}, "v": [[1619784000000000, 42.5]] }],
+		{
+			"columns": [{ "text": "columnA", "type": "number" }],
+			"rows": [[1]]
+		}
+	]`
+
+	resp, err := decodeString(mixedResult, parseOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(resp.Frames) != 2 {
+		t.Fatalf("Expected 2 frames in response, got %d", len(resp.Frames))
+	}
+
+	if resp.Frames[0].Fields[1].Name != "testClass" {
+		t.Errorf("Expected first frame to be the GTS, got %s", resp.Frames[0].Fields[1].Name)
+	}
+
+	if resp.Frames[1].Name != "tableResults" {
+		t.Errorf("Expected second frame to be the table, got %s", resp.Frames[1].Name)
+	}
+}
+
+func TestDecodeStackMixed(t *testing.T) {
+	mixedResult := `[
+		[{ "c": "testClass", "l": {}, "a": {}, "v": [[1619784000000000, 42.5]] }],
+		42,
+		{ "columns": [{ "text": "columnA", "type": "number" }], "rows": [[1]] },
+		{ "key": "value" },
+		[]
+	]`
+
+	resp, err := decodeString(mixedResult, parseOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(resp.Frames) != 3 {
+		t.Fatalf("Expected 3 frames in response, got %d", len(resp.Frames))
+	}
+
+	expectedDepths := []int{0, 1, 2}
+	expectedNames := []string{"", "scalarResult", "tableResults"}
+	for i, frame := range resp.Frames {
+		if frame.Name != expectedNames[i] {
+			t.Errorf("Expected frame %d name to be '%s', got %s", i, expectedNames[i], frame.Name)
+		}
+
+		custom, ok := frame.Meta.Custom.(FrameMetaCustom)
+		if !ok || custom.StackDepth != expectedDepths[i] {
+			t.Errorf("Expected frame %d stack depth to be %d, got %v", i, expectedDepths[i], frame.Meta.Custom)
+		}
+	}
+
+	notices := resp.Frames[0].Meta.Notices
+	if len(notices) != 1 || notices[0].Severity != data.NoticeSeverityWarning {
+		t.Errorf("Expected a warning notice for the unsupported map, got %v", notices)
+	}
+}
+
+func TestDecodeStackUnsupported(t *testing.T) {
+	if _, err := decodeString(`[{ "key": "value" }]`, parseOptions{}); err == nil {
+		t.Error("Expected an error when no stack level is supported")
+	}
+}
+
+func TestDecodeStackEmpty(t *testing.T) {
+	resp, err := decodeString(`[[]]`, parseOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(resp.Frames) != 0 {
+		t.Errorf("Expected an empty GTS list to produce no frame, got %d", len(resp.Frames))
+	}
+}
+
+func TestDecodeStackGTS(t *testing.T) {
 	gtsList := `[
 		{
 			"c": "testClass",
@@ -91,8 +267,7 @@ func TestParseGTSListResult(t *testing.T) {
 		}
 	]`
 
-	gtsListB := []byte(gtsList)
-	resp, err := parseGTSListResult(gtsListB)
+	resp, err := decodeString(gtsList, parseOptions{})
 	if err != nil {
 		t.Error(err)
 	}
@@ -119,20 +294,199 @@ func TestParseGTSListResult(t *testing.T) {
 		t.Errorf("Expected first field name to be 'time', got %s", timeField.Name)
 	}
 
-	expectedFieldName := "testClass{}"
+	expectedFieldName := "testClass"
 	if valueField.Name != expectedFieldName {
 		t.Errorf("Expected second field name to be '%s', got %s", expectedFieldName, valueField.Name)
 	}
+
+	expectedDisplayName := "testClass{}"
+	if valueField.Config.DisplayNameFromDS != expectedDisplayName {
+		t.Errorf("Expected second field display name to be '%s', got %s", expectedDisplayName, valueField.Config.DisplayNameFromDS)
+	}
 }
 
-func TestParseArrayResultString(t *testing.T) {
+func TestDecodeStackGTSLabels(t *testing.T) {
+	gtsList := `[
+		{
+			"c": "testClass",
+			"l": { "host": "h1", "dc": "paris" },
+			"a": { "owner": "ops", "host": "ignored" },
+			"v": [[1619784000000000, 42.5]]
+		}
+	]`
+
+	tests := []struct {
+		name                string
+		opts                parseOptions
+		expectedDisplayName string
+		expectedLabels      data.Labels
+	}{
+		{
+			name:                "default",
+			opts:                parseOptions{},
+			expectedDisplayName: "testClass{dc=paris,host=h1}",
+			expectedLabels:      data.Labels{"host": "h1", "dc": "paris", "owner": "ops"},
+		},
+		{
+			name:                "hide labels",
+			opts:                parseOptions{hideLabels: true, attributesPrefix: "a_"},
+			expectedDisplayName: "testClass",
+			expectedLabels:      data.Labels{"host": "h1", "dc": "paris", "a_owner": "ops", "a_host": "ignored"},
+		},
+		{
+			name:                "legend format",
+			opts:                parseOptions{legendFormat: "{{__name__}} on {{ host }}{{unknown}}"},
+			expectedDisplayName: "testClass on h1",
+			expectedLabels:      data.Labels{"host": "h1", "dc": "paris", "owner": "ops"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp, err := decodeString(gtsList, tt.opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			valueField := resp.Frames[0].Fields[1]
+			if valueField.Config.DisplayNameFromDS != tt.expectedDisplayName {
+				t.Errorf("Expected display name to be '%s', got %s", tt.expectedDisplayName, valueField.Config.DisplayNameFromDS)
+			}
+
+			if !reflect.DeepEqual(valueField.Labels, tt.expectedLabels) {
+				t.Errorf("Expected labels to be %v, got %v", tt.expectedLabels, valueField.Labels)
+			}
+		})
+	}
+}
+
+func TestDecodeStackGTSGeo(t *testing.T) {
+	gtsList := `[
+		{
+			"c": "gps",
+			"l": {},
+			"a": {},
+			"v": [
+				[1619784000000000, 48.85, 2.35, 35, 1],
+				[1619784001000000, 48.86, 2.36, 2],
+				[1619784002000000, 40, 3],
+				[1619784003000000, 4]
+			]
+		}
+	]`
+
+	resp, err := decodeString(gtsList, parseOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	frame := resp.Frames[0]
+	if len(frame.Fields) != 5 {
+		t.Fatalf("Expected 5 fields, got %d", len(frame.Fields))
+	}
+	if frame.Fields[1].Name != "gps" || frame.Fields[2].Name != "latitude" || frame.Fields[3].Name != "longitude" || frame.Fields[4].Name != "elevation" {
+		t.Errorf("Unexpected fields order: %s, %s, %s, %s", frame.Fields[1].Name, frame.Fields[2].Name, frame.Fields[3].Name, frame.Fields[4].Name)
+	}
+
+	if lat, ok := frame.Fields[2].ConcreteAt(0); !ok || lat.(float64) != 48.85 {
+		t.Errorf("Expected first latitude to be 48.85, got %v", lat)
+	}
+	if lon, ok := frame.Fields[3].ConcreteAt(1); !ok || lon.(float64) != 2.36 {
+		t.Errorf("Expected second longitude to be 2.36, got %v", lon)
+	}
+	if _, ok := frame.Fields[2].ConcreteAt(2); ok {
+		t.Error("Expected third latitude to be null")
+	}
+	if elev, ok := frame.Fields[4].ConcreteAt(2); !ok || elev.(float64) != 40 {
+		t.Errorf("Expected third elevation to be 40, got %v", elev)
+	}
+	if value := frame.Fields[1].At(3); value.(int64) != 4 {
+		t.Errorf("Expected last value to be 4, got %v", value)
+	}
+
+	resp, err = decodeString(gtsList, parseOptions{geoPoints: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	frame = resp.Frames[0]
+	if frame.Name != "gps{}" {
+		t.Errorf("Expected point list frame to be named 'gps{}', got %s", frame.Name)
+	}
+	if frame.Rows() != 2 {
+		t.Errorf("Expected only the 2 located datapoints, got %d", frame.Rows())
+	}
+}
+
+func TestDecodeStackGTSWithoutLocation(t *testing.T) {
+	resp, err := decodeString(`[{"c": "testClass", "l": {}, "a": {}, "v": [[1619784000000000, 42.5]]}]`, parseOptions{geoPoints: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(resp.Frames[0].Fields) != 2 || resp.Frames[0].Rows() != 1 {
+		t.Errorf("Expected series without location to be left as is, got %d fields and %d rows", len(resp.Frames[0].Fields), resp.Frames[0].Rows())
+	}
+}
+
+func TestDecodeStackGTSTypes(t *testing.T) {
+	gtsList := `[[
+		{"c": "double", "l": {}, "a": {}, "v": [[1619784000000000, 42.0], [1619784001000000, 43.5]]},
+		{"c": "long", "l": {}, "a": {}, "v": [[1619784000000000, 9007199254740993], [1619784001000000, -1]]},
+		{"c": "boolean", "l": {}, "a": {}, "v": [[1619784000000000, true], [1619784001000000, false]]},
+		{"c": "string", "l": {}, "a": {}, "v": [[1619784000000000, "up"]]},
+		{"c": "numbers", "l": {}, "a": {}, "v": [[1619784000000000, 1], [1619784001000000, 2.5]]},
+		{"c": "mixed", "l": {}, "a": {}, "v": [[1619784000000000, 1], [1619784001000000, true], [1619784002000000, "up"]]}
+	]]`
+
+	resp, err := decodeString(gtsList, parseOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []struct {
+		fieldType data.FieldType
+		values    []interface{}
+	}{
+		{data.FieldTypeFloat64, []interface{}{42.0, 43.5}},
+		{data.FieldTypeInt64, []interface{}{int64(9007199254740993), int64(-1)}},
+		{data.FieldTypeBool, []interface{}{true, false}},
+		{data.FieldTypeString, []interface{}{"up"}},
+		{data.FieldTypeFloat64, []interface{}{1.0, 2.5}},
+		{data.FieldTypeString, []interface{}{"1", "true", "up"}},
+	}
+
+	if len(resp.Frames) != len(expected) {
+		t.Fatalf("Expected %d frames in response, got %d", len(expected), len(resp.Frames))
+	}
+
+	for i, e := range expected {
+		field := resp.Frames[i].Fields[1]
+		if field.Type() != e.fieldType {
+			t.Errorf("%s: expected %s field, got %s", field.Name, e.fieldType, field.Type())
+			continue
+		}
+		for j, value := range e.values {
+			if field.At(j) != value {
+				t.Errorf("%s: expected value %d to be %v, got %v", field.Name, j, value, field.At(j))
+			}
+		}
+	}
+
+	timeField := resp.Frames[0].Fields[0]
+	if ts := timeField.At(1).(time.Time); ts.UnixMicro() != 1619784001000000 {
+		t.Errorf("Expected second timestamp to be 1619784001000000, got %d", ts.UnixMicro())
+	}
+}
+
+func TestDecodeStackArrayString(t *testing.T) {
 	stringArray := `[[
 		"value1",
 		"value2",
 		"value3"
 	]]`
 
-	resp, err := parseArrayResult([]byte(stringArray))
+	resp, err := decodeString(stringArray, parseOptions{})
 	if err != nil {
 		t.Error(err)
 	}
@@ -164,14 +518,14 @@ func TestParseArrayResultString(t *testing.T) {
 	}
 }
 
-func TestParseArrayResultFloat64(t *testing.T) {
+func TestDecodeStackArrayFloat64(t *testing.T) {
 	floatArray := `[[
 		42,
 		43,
 		44
 	]]`
 
-	resp, err := parseArrayResult([]byte(floatArray))
+	resp, err := decodeString(floatArray, parseOptions{})
 	if err != nil {
 		t.Error(err)
 	}
@@ -203,14 +557,14 @@ func TestParseArrayResultFloat64(t *testing.T) {
 	}
 }
 
-func TestParseArrayResultBool(t *testing.T) {
+func TestDecodeStackArrayBool(t *testing.T) {
 	boolArray := `[[
 		true,
 		false,
 		true
 	]]`
 
-	resp, err := parseArrayResult([]byte(boolArray))
+	resp, err := decodeString(boolArray, parseOptions{})
 	if err != nil {
 		t.Error(err)
 	}
@@ -242,10 +596,10 @@ func TestParseArrayResultBool(t *testing.T) {
 	}
 }
 
-func TestParseScalarResultString(t *testing.T) {
+func TestDecodeStackScalarString(t *testing.T) {
 	stringScalar := `["test value"]`
 
-	resp, err := parseScalarResult([]byte(stringScalar))
+	resp, err := decodeString(stringScalar, parseOptions{})
 	if err != nil {
 		t.Error(err)
 	}
@@ -270,10 +624,10 @@ func TestParseScalarResultString(t *testing.T) {
 	}
 }
 
-func TestParseScalarResultFloat64(t *testing.T) {
+func TestDecodeStackScalarFloat64(t *testing.T) {
 	floatScalar := `[42.5]`
 
-	resp, err := parseScalarResult([]byte(floatScalar))
+	resp, err := decodeString(floatScalar, parseOptions{})
 	if err != nil {
 		t.Error(err)
 	}
@@ -298,10 +652,10 @@ func TestParseScalarResultFloat64(t *testing.T) {
 	}
 }
 
-func TestParseScalarResultBool(t *testing.T) {
+func TestDecodeStackScalarBool(t *testing.T) {
 	boolScalar := `[true]`
 
-	resp, err := parseScalarResult([]byte(boolScalar))
+	resp, err := decodeString(boolScalar, parseOptions{})
 	if err != nil {
 		t.Error(err)
 	}
@@ -408,3 +762,27 @@ func TestNameWithLabelsInOrder(t *testing.T) {
 		t.Errorf("Wrong gts name. Expected %s got %s", expectedFullName, fullName)
 	}
 }
+
+// newTestDatasource returns a datasource executing its scripts on a test
+// warp10 server, closed at the end of the test
+func newTestDatasource(t *testing.T, handler http.HandlerFunc) *Datasource {
+	server := httptest.NewServer(handler)
+	t.Cleanup(server.Close)
+
+	d := &Datasource{client: b.NewClient(server.URL)}
+	d.client.HTTPClient = server.Client()
+
+	return d
+}
+
+// checkFrames makes sure the fields of every frame have the same length
+func checkFrames(t *testing.T, resp backend.DataResponse) {
+	for _, frame := range resp.Frames {
+		if frame == nil {
+			t.Fatal("Unexpected nil frame")
+		}
+		if _, err := frame.RowLen(); err != nil {
+			t.Errorf("Frame %q: %v", frame.Name, err)
+		}
+	}
+}
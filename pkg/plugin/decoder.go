@@ -0,0 +1,426 @@
+package plugin
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/grafana/grafana-plugin-sdk-go/data"
+	b "github.com/miton18/go-warp10/base"
+	"io"
+)
+
+/*
+	Supported stack levels are:
+	- Array of String,Int64,Float64
+	- String, Int64, Float64 element
+	- GTS: {...}
+	- Array of GTS: [ {...}, {...}, ... ]
+	- Nested arrays of GTS: [ [ {...}, {...}, ... ], {...}, ... ]
+	- Table: { columns: [...], rows: [...] }
+
+	decodeStack converts the warp10 stack in a single pass of a json.Decoder:
+	each level is classified from its first token and converted while it's
+	read, a GTS being converted to preallocated columns as soon as its
+	datapoints are read, so that its decoded values can be freed before the
+	next GTS. Every frame carries its stack depth (0 being the top of the
+	stack) in its custom metadata. A level that can't be converted is
+	reported as a notice of the first frame, the query only fails when no
+	level can be converted at all.
+*/
+
+// levelSpanNames are the span names of the stack levels, by shape
+var levelSpanNames = map[string]string{
+	shapeTable:       "decode table",
+	shapeGTSList:     "decode gts list",
+	shapeArray:       "decode array",
+	shapeScalar:      "decode scalar",
+	shapeUnsupported: "decode unsupported",
+}
+
+// stackDecoder reads the levels of a warp10 stack
+type stackDecoder struct {
+	dec  *json.Decoder
+	opts parseOptions
+}
+
+// decodeStack reads the warp10 stack from r and converts each of its levels
+func decodeStack(ctx context.Context, r io.Reader, opts parseOptions) (backend.DataResponse, error) {
+	dec := json.NewDecoder(r)
+	// numbers are kept as json.Number, so that LONG values above 2^53 stay exact
+	dec.UseNumber()
+	s := &stackDecoder{dec: dec, opts: opts}
+
+	if err := s.expectDelim('['); err != nil {
+		return backend.DataResponse{}, fmt.Errorf("stack parsing error: %v", err)
+	}
+
+	var frames data.Frames
+	var notices []data.Notice
+	for depth := 0; dec.More(); depth++ {
+		levelFrames, levelErr, err := s.level(ctx, depth)
+		if err != nil {
+			return backend.DataResponse{}, fmt.Errorf("stack parsing error: %v", err)
+		}
+		frames, notices = appendStackLevel(frames, notices, depth, levelFrames, levelErr)
+	}
+
+	if err := s.expectDelim(']'); err != nil {
+		return backend.DataResponse{}, fmt.Errorf("stack parsing error: %v", err)
+	}
+	if _, err := dec.Token(); err != io.EOF {
+		return backend.DataResponse{}, fmt.Errorf("stack parsing error: unexpected data after the stack")
+	}
+
+	return stackResponse(frames, notices)
+}
+
+// decodedStack is the result of decodeStack on an exec response, shared by the
+// coalesced executions
+type decodedStack struct {
+	frames data.Frames
+	err    error
+}
+
+// gtsErrors are the conversion errors of some GTS of a list, which keeps the
+// frames of the other GTS
+type gtsErrors []gtsError
+
+// gtsError is the conversion error of the GTS at index in its list
+type gtsError struct {
+	index int
+	err   error
+}
+
+func (e gtsErrors) Error() string {
+	return fmt.Sprintf("%d GTS ignored, first at index %d: %v", len(e), e[0].index, e[0].err)
+}
+
+// appendStackLevel appends the frames of a stack level, and the notices of its
+// conversion errors: one for the level, or one per GTS of a list
+func appendStackLevel(frames data.Frames, notices []data.Notice, depth int, levelFrames data.Frames, err error) (data.Frames, []data.Notice) {
+	if errs, ok := err.(gtsErrors); ok {
+		for _, gtsErr := range errs {
+			notices = append(notices, data.Notice{
+				Severity: data.NoticeSeverityWarning,
+				Text:     fmt.Sprintf("stack depth %d, GTS %d ignored: %v", depth, gtsErr.index, gtsErr.err),
+			})
+		}
+	} else if err != nil {
+		return frames, append(notices, data.Notice{
+			Severity: data.NoticeSeverityWarning,
+			Text:     fmt.Sprintf("stack depth %d ignored: %v", depth, err),
+		})
+	}
+
+	for _, frame := range levelFrames {
+		if frame.Meta == nil {
+			frame.Meta = &data.FrameMeta{}
+		}
+		custom, _ := frame.Meta.Custom.(FrameMetaCustom)
+		custom.StackDepth = depth
+		frame.Meta.Custom = custom
+	}
+	return append(frames, levelFrames...), notices
+}
+
+// stackResponse returns the frames of the stack, the notices being attached to
+// the first one. It fails when no level could be converted at all.
+func stackResponse(frames data.Frames, notices []data.Notice) (backend.DataResponse, error) {
+	if len(frames) == 0 && len(notices) > 0 {
+		return backend.DataResponse{}, fmt.Errorf("no supported response type found")
+	}
+	if len(notices) > 0 {
+		frames[0].AppendNotices(notices...)
+	}
+
+	return backend.DataResponse{Frames: frames}, nil
+}
+
+// expectDelim reads a delimiter
+func (s *stackDecoder) expectDelim(delim json.Delim) error {
+	tok, err := s.dec.Token()
+	if err != nil {
+		return err
+	}
+	if tok != delim {
+		return fmt.Errorf("expected %v, got %v", delim, tok)
+	}
+
+	return nil
+}
+
+// level reads and converts a stack level in its own span. levelErr is the
+// conversion error of the level, err a decoding error of the whole stack.
+func (s *stackDecoder) level(ctx context.Context, depth int) (frames data.Frames, levelErr error, err error) {
+	_, span := startSpan(ctx, "decodeStackLevel", attributeStackDepth.Int(depth))
+
+	shape, frames, levelErr, err := s.convertLevel()
+	span.SetName(levelSpanNames[shape])
+	span.SetAttributes(attributeShape.String(shape))
+	spanRes := backend.DataResponse{Frames: frames, Error: levelErr}
+	if err != nil {
+		spanRes.Error = err
+	}
+	endQuerySpan(span, spanRes)
+
+	if err != nil {
+		return nil, nil, err
+	}
+	s.opts.metrics.parsed(shape, levelErr)
+
+	return frames, levelErr, nil
+}
+
+// convertLevel reads a stack level and returns its shape and frames
+func (s *stackDecoder) convertLevel() (shape string, frames data.Frames, levelErr error, err error) {
+	tok, err := s.dec.Token()
+	if err != nil {
+		return shapeUnsupported, nil, nil, err
+	}
+
+	switch tok {
+	case json.Delim('{'):
+		obj, err := s.object()
+		if err != nil {
+			return shapeUnsupported, nil, nil, err
+		}
+		switch {
+		case obj.isTable():
+			frame, err := tableToFrame(obj.table)
+			if err != nil {
+				return shapeTable, nil, fmt.Errorf("table parsing error: %v", err), nil
+			}
+			return shapeTable, data.Frames{frame}, nil, nil
+		case obj.isGTS():
+			frame, err := obj.gtsFrame(s.opts)
+			if err != nil {
+				return shapeGTSList, nil, err, nil
+			}
+			return shapeGTSList, data.Frames{frame}, nil, nil
+		default:
+			return shapeUnsupported, nil, fmt.Errorf("maps are not supported"), nil
+		}
+
+	case json.Delim('['):
+		var list stackList
+		if err := s.list(&list, false); err != nil {
+			return shapeUnsupported, nil, nil, err
+		}
+		if !list.other {
+			// an empty list (a FETCH without data) produces no frame
+			if len(list.gtsErrs) > 0 {
+				return shapeGTSList, list.frames, list.gtsErrs, nil
+			}
+			return shapeGTSList, list.frames, nil, nil
+		}
+		if list.gts || list.lists || list.maps {
+			return shapeArray, nil, fmt.Errorf("array parsing error: unsupported data type for array_value"), nil
+		}
+		if list.err != nil {
+			return shapeArray, nil, list.err, nil
+		}
+		frame, err := arrayFrame(list.values)
+		if err != nil {
+			return shapeArray, nil, err, nil
+		}
+		return shapeArray, data.Frames{frame}, nil, nil
+
+	default:
+		value, err := jsonValue(tok)
+		if err != nil {
+			return shapeScalar, nil, err, nil
+		}
+		frame, err := scalarFrame(value)
+		if err != nil {
+			return shapeScalar, nil, err, nil
+		}
+		return shapeScalar, data.Frames{frame}, nil, nil
+	}
+}
+
+// stackObject is a map read from the stack, which may be a table or a GTS
+type stackObject struct {
+	table TableResult
+	// a table member has an unexpected type
+	tableErr error
+
+	gts                 b.GTS
+	hasClass, hasValues bool
+	// a GTS member has an unexpected type
+	gtsErr error
+}
+
+// isTable tells if the map is a table: a map with columns and rows
+func (o *stackObject) isTable() bool {
+	return o.tableErr == nil && o.table.Columns != nil && o.table.Rows != nil
+}
+
+// isGTS tells if the map is a GTS: a map with a class and values
+func (o *stackObject) isGTS() bool {
+	return o.hasClass && o.hasValues
+}
+
+// gtsFrame converts the GTS of the map
+func (o *stackObject) gtsFrame(opts parseOptions) (*data.Frame, error) {
+	if o.gtsErr != nil {
+		return nil, fmt.Errorf("GTSList parsing error")
+	}
+
+	return gtsToFrame(&o.gts, opts)
+}
+
+// object reads the members of a map, once its opening brace is read
+func (s *stackDecoder) object() (*stackObject, error) {
+	obj := &stackObject{}
+	for s.dec.More() {
+		tok, err := s.dec.Token()
+		if err != nil {
+			return nil, err
+		}
+		key, _ := tok.(string)
+
+		var target interface{}
+		var memberErr *error
+		switch key {
+		case "columns":
+			target, memberErr = &obj.table.Columns, &obj.tableErr
+		case "rows":
+			target, memberErr = &obj.table.Rows, &obj.tableErr
+		case "name":
+			target, memberErr = &obj.table.Name, &obj.tableErr
+		case "title":
+			target, memberErr = &obj.table.Title, &obj.tableErr
+		case "c":
+			target, memberErr = &obj.gts.ClassName, &obj.gtsErr
+			obj.hasClass = true
+		case "l":
+			target, memberErr = &obj.gts.Labels, &obj.gtsErr
+		case "a":
+			target, memberErr = &obj.gts.Attributes, &obj.gtsErr
+		case "la":
+			target, memberErr = &obj.gts.LastActivity, &obj.gtsErr
+		case "v":
+			target, memberErr = &obj.gts.Values, &obj.gtsErr
+			obj.hasValues = true
+		default:
+			var ignored json.RawMessage
+			target = &ignored
+		}
+
+		if err := s.dec.Decode(target); err != nil {
+			var typeErr *json.UnmarshalTypeError
+			if !errors.As(err, &typeErr) || memberErr == nil {
+				return nil, err
+			}
+			// the member is read anyway, the map is just not what it looks like
+			*memberErr = err
+		}
+	}
+
+	if err := s.expectDelim('}'); err != nil {
+		return nil, err
+	}
+
+	// table cells are numbers, like with json.Unmarshal
+	for _, row := range obj.table.Rows {
+		for i, cell := range row {
+			if number, ok := cell.(json.Number); ok {
+				value, err := number.Float64()
+				if err != nil {
+					obj.tableErr = err
+				}
+				row[i] = value
+			}
+		}
+	}
+
+	return obj, nil
+}
+
+// stackList is a list read from the stack, which is a GTS list when it's only
+// made of GTS and nested lists of GTS, a list of values otherwise
+type stackList struct {
+	// frames of the GTS, in the order of the list
+	frames data.Frames
+	// GTS read, and the ones that couldn't be converted
+	gtsCount int
+	gtsErrs  gtsErrors
+	// values, when it's not a GTS list
+	values []interface{}
+	// it holds GTS, nested lists, other maps or other values
+	gts, lists, maps, other bool
+	// a value couldn't be converted
+	err error
+}
+
+// list reads the elements of a list, once its opening bracket is read. The
+// elements of nested lists are added to the same stackList.
+func (s *stackDecoder) list(list *stackList, nested bool) error {
+	for s.dec.More() {
+		tok, err := s.dec.Token()
+		if err != nil {
+			return err
+		}
+
+		switch tok {
+		case json.Delim('{'):
+			obj, err := s.object()
+			if err != nil {
+				return err
+			}
+			if !obj.isGTS() {
+				list.maps, list.other = true, true
+				continue
+			}
+			list.gts = true
+			if list.other {
+				// the level fails anyway, the remaining GTS are only read
+				continue
+			}
+			frame, err := obj.gtsFrame(s.opts)
+			list.gtsCount++
+			if err != nil {
+				list.gtsErrs = append(list.gtsErrs, gtsError{index: list.gtsCount - 1, err: err})
+				continue
+			}
+			list.frames = append(list.frames, frame)
+
+		case json.Delim('['):
+			list.lists = true
+			if err := s.list(list, true); err != nil {
+				return err
+			}
+
+		default:
+			list.other = true
+			if nested {
+				continue
+			}
+			value, err := jsonValue(tok)
+			if err != nil && list.err == nil {
+				list.err = err
+			}
+			list.values = append(list.values, value)
+		}
+	}
+
+	return s.expectDelim(']')
+}
+
+// jsonValue returns a value token as json.Unmarshal decodes it in an
+// interface, numbers being float64
+func jsonValue(tok json.Token) (interface{}, error) {
+	number, ok := tok.(json.Number)
+	if !ok {
+		return tok, nil
+	}
+
+	value, err := number.Float64()
+	if err != nil {
+		return nil, fmt.Errorf("number parsing error: %v", err)
+	}
+
+	return value, nil
+}
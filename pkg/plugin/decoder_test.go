@@ -0,0 +1,230 @@
+package plugin
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/grafana/grafana-plugin-sdk-go/data"
+	b "github.com/miton18/go-warp10/base"
+	"io"
+	"strings"
+	"testing"
+)
+
+// decoderStacks cover every level shape, and the levels that can't be
+// converted, they seed FuzzDecodeStack
+var decoderStacks = []string{
+	`[]`,
+	`["scalar", 42.5, 1, true, false]`,
+	`[null]`,
+	`[["a", null, "b"], [1, 2.5], [true], [null], [null, null]]`,
+	`[[1, "mixed", true]]`,
+	`[[[1, 2], {"k": "v"}]]`,
+	`[[1, []], [[], 1], [null, {"c": "c", "v": [[1, 2]]}]]`,
+	`[[], [[]], [[[]]]]`,
+	`[{"c": "c", "l": {"k": "v"}, "a": {"at": "tr"}, "la": 3, "v": [[1619784000000000, 42.5], [1619784001000000, 43]]}]`,
+	`[[{"c": "c", "v": [[1, 48.85, 2.35, 35, true], [2, "x"]]}], {"c": "d", "v": [[]]}]`,
+	`[[{"c": "a", "v": [[1, 9007199254740993]]}, [{"c": "b", "v": [[2, "s"]]}, [{"c": "c", "v": [[3, false]]}]]]]`,
+	`[[{"c": "a", "v": [[1, 2]]}, 3]]`,
+	`[[{"c": "a", "v": "x"}], {"c": 1, "v": [[1, 2]]}, {"c": "b", "v": [[1, 2]], "l": []}]`,
+	`[{"columns": [{"text": "a"}, {"text": "b"}], "rows": [[10, 20], [100]], "name": "n"}]`,
+	`[{"columns": [{"text": "a"}], "rows": [[{"nested": true}]]}, {"c": "c", "v": [[1, 2]]}]`,
+	`[{"columns": [], "rows": [[]]}, {"columns": null, "rows": []}, {"columns": 1, "rows": []}]`,
+	`[{"key": "value"}, {}, [{"key": "value"}], [{"columns": [], "rows": []}]]`,
+	`[1e400, [1e400], {"c": "c", "v": [[1e400, 1e400]]}]`,
+	`[{"c": "c", "v": [[1, 2]], "v": [[3, 4]]}]`,
+	`[null, {"v": [[1e400, 1e400]]}]`,
+}
+
+// decodeString decodes a stack given as a string
+func decodeString(stack string, opts parseOptions) (backend.DataResponse, error) {
+	return decodeStack(context.Background(), strings.NewReader(stack), opts)
+}
+
+func TestDecodeStackErrors(t *testing.T) {
+	for _, stack := range []string{``, `{}`, `42`, `[1, 2`, `[1, 2] 3`, `[{"c": "c", "v": [[1, 2]]`, `[{"c": }]`, `[[1,]]`} {
+		if _, err := decodeString(stack, parseOptions{}); err == nil {
+			t.Errorf("Expected an error for %q", stack)
+		}
+	}
+}
+
+func FuzzDecodeStack(f *testing.F) {
+	for _, stack := range decoderStacks {
+		f.Add([]byte(stack))
+	}
+
+	f.Fuzz(func(t *testing.T, result []byte) {
+		res, err := decodeStack(context.Background(), bytes.NewReader(result), parseOptions{})
+		if err == nil {
+			checkFrames(t, res)
+		}
+	})
+}
+
+func TestDecodeStackGTSListOrder(t *testing.T) {
+	var gtsList []string
+	for i := 0; i < 1000; i++ {
+		gtsList = append(gtsList, fmt.Sprintf(`{"c": "class%d", "v": [[1, %d]]}`, i, i))
+	}
+
+	resp, err := decodeString(`[[`+strings.Join(gtsList, ",")+`]]`, parseOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(resp.Frames) != len(gtsList) {
+		t.Fatalf("Expected %d frames, got %d", len(gtsList), len(resp.Frames))
+	}
+	for i, frame := range resp.Frames {
+		if name := frame.Fields[1].Name; name != fmt.Sprintf("class%d", i) || frame.Fields[1].At(0) != int64(i) {
+			t.Fatalf("Expected frame %d to be the one of its GTS, got %s", i, name)
+		}
+	}
+
+	gtsList[500] = `{"c": "class500", "v": [[1, 2]], "l": []}`
+	gtsList[700] = `{"c": "class700", "v": [[1, 2]], "a": []}`
+	resp, err = decodeString(`[[`+strings.Join(gtsList, ",")+`]]`, parseOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(resp.Frames) != len(gtsList)-2 {
+		t.Fatalf("Expected the frames of the other GTS to be kept, got %d", len(resp.Frames))
+	}
+	notices := resp.Frames[0].Meta.Notices
+	if len(notices) != 2 || !strings.Contains(notices[0].Text, "GTS 500") || !strings.Contains(notices[1].Text, "GTS 700") {
+		t.Errorf("Expected a notice per failed GTS, got %v", notices)
+	}
+
+	resp, err = decodeString(`[{"c": "a", "v": [[1, 2]], "l": []}]`, parseOptions{})
+	if err == nil {
+		t.Errorf("Expected a stack without any converted GTS to fail, got %d frames", len(resp.Frames))
+	}
+}
+
+// benchmarkGTSList returns a GTS list of series GTS of points datapoints
+func benchmarkGTSList(series int, points int) string {
+	var sb strings.Builder
+	sb.WriteString(`[`)
+	for i := 0; i < series; i++ {
+		if i > 0 {
+			sb.WriteString(`,`)
+		}
+		fmt.Fprintf(&sb, `{"c": "os.cpu", "l": {"host": "h%d"}, "a": {}, "la": 0, "v": [`, i)
+		for j := 0; j < points; j++ {
+			if j > 0 {
+				sb.WriteString(`,`)
+			}
+			fmt.Fprintf(&sb, `[%d, %d.5]`, 1700000000000000+int64(j)*1000000, j)
+		}
+		sb.WriteString(`]}`)
+	}
+	sb.WriteString(`]`)
+
+	return sb.String()
+}
+
+// parseStackReadAll converts a stack the way query did before decodeStack: the
+// whole body is read, split in levels, and every level unmarshalled again by
+// its parser. It's kept as the baseline of BenchmarkParseStack.
+func parseStackReadAll(r io.Reader) (data.Frames, error) {
+	body, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	var stack []json.RawMessage
+	if err := json.Unmarshal(body, &stack); err != nil {
+		return nil, err
+	}
+
+	var frames data.Frames
+	for _, level := range stack {
+		dec := json.NewDecoder(bytes.NewReader(level))
+		dec.UseNumber()
+		var gtsList []*b.GTS
+		if err := dec.Decode(&gtsList); err == nil {
+			for _, gts := range gtsList {
+				frame, err := gtsToFrame(gts, parseOptions{})
+				if err != nil {
+					return nil, err
+				}
+				frames = append(frames, frame)
+			}
+			continue
+		}
+
+		var value interface{}
+		if err := json.Unmarshal(level, &value); err != nil {
+			return nil, err
+		}
+		var frame *data.Frame
+		if values, ok := value.([]interface{}); ok {
+			frame, err = arrayFrame(values)
+		} else {
+			frame, err = scalarFrame(value)
+		}
+		if err != nil {
+			return nil, err
+		}
+		frames = append(frames, frame)
+	}
+
+	return frames, nil
+}
+
+// BenchmarkParseStack compares the former read-all path with decodeStack on
+// the same stacks
+func BenchmarkParseStack(bench *testing.B) {
+	stack := []byte(`[` + benchmarkGTSList(1000, 1000) + `, ["a", "b"], 42]`)
+
+	for _, parser := range []struct {
+		name  string
+		parse func(r io.Reader) error
+	}{
+		{"readAll", func(r io.Reader) error {
+			_, err := parseStackReadAll(r)
+			return err
+		}},
+		{"decodeStack", func(r io.Reader) error {
+			_, err := decodeStack(context.Background(), r, parseOptions{})
+			return err
+		}},
+	} {
+		bench.Run(parser.name, func(bench *testing.B) {
+			bench.SetBytes(int64(len(stack)))
+			bench.ReportAllocs()
+			bench.ResetTimer()
+
+			for i := 0; i < bench.N; i++ {
+				if err := parser.parse(bytes.NewReader(stack)); err != nil {
+					bench.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkDecodeStack(b *testing.B) {
+	// a long series, and many short ones
+	for _, shape := range []struct {
+		series int
+		points int
+	}{
+		{1, 1000000},
+		{100000, 10},
+	} {
+		b.Run(fmt.Sprintf("%dx%d", shape.series, shape.points), func(b *testing.B) {
+			stack := []byte(`[` + benchmarkGTSList(shape.series, shape.points) + `, ["a", "b"], 42]`)
+			b.SetBytes(int64(len(stack)))
+			b.ReportAllocs()
+			b.ResetTimer()
+
+			for i := 0; i < b.N; i++ {
+				if _, err := decodeStack(context.Background(), bytes.NewReader(stack), parseOptions{}); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,141 @@
+package plugin
+
+import (
+	"context"
+	"fmt"
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	b "github.com/miton18/go-warp10/base"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// execError is a failed WarpScript execution, as reported by warp10 in the
+// X-Warp10-Error-Message and X-Warp10-Error-Line response headers
+type execError struct {
+	// HTTP status of the exec call
+	StatusCode int
+	// warp10 error message, e.g. Exception at '=>FOO<=' in section [TOP] (Unknown function 'FOO')
+	Message string
+	// failing line in the user script, 0 when unknown or in the injected prelude
+	Line int
+	// failing statement, extracted from the message
+	Statement string
+	// the failing line belongs to the WarpScript injected by the backend
+	inPrelude bool
+}
+
+// statementRegexp matches the failing statement of a warp10 error message
+var statementRegexp = regexp.MustCompile(`'=>(.*?)<='`)
+
+// newExecError reads the warp10 error headers of a failed exec call
+func newExecError(res *http.Response) *execError {
+	e := &execError{
+		StatusCode: res.StatusCode,
+		Message:    res.Header.Get(b.HeaderErrorMessage),
+	}
+	if e.Message == "" {
+		e.Message = res.Status
+	}
+
+	if line, err := strconv.Atoi(res.Header.Get(b.HeaderErrorLine)); err == nil && line > 0 {
+		e.Line = line
+	}
+	if match := statementRegexp.FindStringSubmatch(e.Message); match != nil {
+		e.Statement = match[1]
+	}
+
+	return e
+}
+
+// shiftLine makes the line relative to the user script, preludeLines being the
+// number of lines injected before it
+func (e *execError) shiftLine(preludeLines int) {
+	if e.Line == 0 {
+		return
+	}
+
+	e.Line -= preludeLines
+	if e.Line <= 0 {
+		e.Line = 0
+		e.inPrelude = true
+	}
+}
+
+func (e *execError) Error() string {
+	var location []string
+	switch {
+	case e.inPrelude:
+		location = append(location, "datasource prelude")
+	case e.Line > 0:
+		location = append(location, fmt.Sprintf("line %d", e.Line))
+	}
+	if e.Statement != "" {
+		location = append(location, fmt.Sprintf("statement %s", e.Statement))
+	}
+
+	if len(location) == 0 {
+		return fmt.Sprintf("WarpScript error: %s", e.Message)
+	}
+	return fmt.Sprintf("WarpScript error at %s: %s", strings.Join(location, ", "), e.Message)
+}
+
+// authErrors and syntaxErrors are lower-cased parts of the warp10 messages
+// reporting a token or a WarpScript syntax problem
+var (
+	authErrors   = []string{"invalid token", "missing token", "token expired", "expired token", "invalid read token", "invalid write token"}
+	syntaxErrors = []string{"unknown function", "unbalanced", "syntax error", "parse error", "invalid syntax", "unclosed"}
+)
+
+// status returns the Grafana status matching the failure
+func (e *execError) status() backend.Status {
+	switch e.StatusCode {
+	case http.StatusUnauthorized:
+		return backend.StatusUnauthorized
+	case http.StatusForbidden:
+		return backend.StatusForbidden
+	case http.StatusBadRequest:
+		return backend.StatusBadRequest
+	}
+
+	message := strings.ToLower(e.Message)
+	for _, part := range authErrors {
+		if strings.Contains(message, part) {
+			return backend.StatusUnauthorized
+		}
+	}
+	for _, part := range syntaxErrors {
+		if strings.Contains(message, part) {
+			return backend.StatusBadRequest
+		}
+	}
+
+	return backend.StatusInternal
+}
+
+// responseTooLargeError is an exec response above the maximum response size
+type responseTooLargeError struct {
+	// maximum response size in bytes
+	Limit int64
+}
+
+func (e *responseTooLargeError) Error() string {
+	return fmt.Sprintf("warp10 response larger than the maximum response size of %d MB, reduce the result of the query", e.Limit>>20)
+}
+
+// queryTimeoutError is the cause of a context done at the datasource query
+// timeout, telling it apart from the deadline of the Grafana request
+type queryTimeoutError struct {
+	Timeout time.Duration
+}
+
+func (e *queryTimeoutError) Error() string {
+	return fmt.Sprintf("query timed out after %v", e.Timeout)
+}
+
+// Is makes the query timeout a context.DeadlineExceeded
+func (e *queryTimeoutError) Is(target error) bool {
+	return target == context.DeadlineExceeded
+}
@@ -0,0 +1,87 @@
+package plugin
+
+import (
+	"context"
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	b "github.com/miton18/go-warp10/base"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestQueryExecError(t *testing.T) {
+	var prelude string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		script, _ := io.ReadAll(r.Body)
+		prelude = strings.TrimSuffix(string(script), "1 FOO")
+
+		// warp10 reports the line in the whole script
+		w.Header().Set(b.HeaderErrorLine, strconv.Itoa(strings.Count(prelude, "\n")+1))
+		w.Header().Set(b.HeaderErrorMessage, "Exception at '=>FOO<=' in section [TOP] (Unknown function 'FOO')")
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer server.Close()
+
+	instance, err := NewDatasource(context.Background(), backend.DataSourceInstanceSettings{
+		JSONData: []byte(`{"path": "` + server.URL + `", "macro": [{"name": "m", "value": "<% 1\n2 %>"}]}`),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	res := instance.(*Datasource).query(context.Background(), backend.PluginContext{}, backend.DataQuery{
+		RefID: "A",
+		JSON:  []byte(`{"expr": "1 FOO"}`),
+	})
+
+	if res.Status != backend.StatusBadRequest {
+		t.Errorf("Expected status to be %v, got %v", backend.StatusBadRequest, res.Status)
+	}
+
+	expected := "WarpScript error at line 1, statement FOO: Exception at '=>FOO<=' in section [TOP] (Unknown function 'FOO')"
+	if res.Error == nil || res.Error.Error() != expected {
+		t.Errorf("Expected error to be %q, got %v", expected, res.Error)
+	}
+
+	// the dashboard variables prepended by the frontend are not part of the editor lines
+	res = instance.(*Datasource).query(context.Background(), backend.PluginContext{}, backend.DataQuery{
+		RefID: "A",
+		JSON:  []byte(`{"expr": "[ 'a' ] 'v_list' STORE\n'a' 'v' STORE\n1 FOO", "headerLines": 2}`),
+	})
+	if res.Error == nil || res.Error.Error() != expected {
+		t.Errorf("Expected error to be %q, got %v", expected, res.Error)
+	}
+}
+
+func TestExecErrorStatus(t *testing.T) {
+	tests := []struct {
+		statusCode int
+		message    string
+		expected   backend.Status
+	}{
+		{http.StatusInternalServerError, "Exception at '=>FETCH<=' in section [TOP] (Invalid token.)", backend.StatusUnauthorized},
+		{http.StatusForbidden, "", backend.StatusForbidden},
+		{http.StatusInternalServerError, "Exception at '=><%<=' in section [TOP] (Unbalanced macro.)", backend.StatusBadRequest},
+		{http.StatusInternalServerError, "Exception at '=>FAIL<=' in section [TOP] (Operation failed.)", backend.StatusInternal},
+	}
+
+	for _, tt := range tests {
+		e := &execError{StatusCode: tt.statusCode, Message: tt.message}
+		if status := e.status(); status != tt.expected {
+			t.Errorf("%d %q: expected status %v, got %v", tt.statusCode, tt.message, tt.expected, status)
+		}
+	}
+}
+
+func TestExecErrorInPrelude(t *testing.T) {
+	e := &execError{Message: "Exception at '=>STORE<=' in section [TOP]", Line: 3, Statement: "STORE"}
+	e.shiftLine(8)
+
+	expected := "WarpScript error at datasource prelude, statement STORE: Exception at '=>STORE<=' in section [TOP]"
+	if e.Error() != expected {
+		t.Errorf("Expected error to be %q, got %q", expected, e.Error())
+	}
+}
@@ -0,0 +1,128 @@
+package plugin
+
+import (
+	"context"
+	"errors"
+	"github.com/grafana/grafana-plugin-sdk-go/backend/tracing"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// default maximum size of an exec response in MB, above the few hundred MB
+// responses of the largest dashboards
+const defaultMaxResponseSize = 512
+
+// maxResponseBytes returns the maximum size of a warp10 response in bytes from
+// the setting in MB: defaultMaxResponseSize when not set, 0 (no limit) when
+// negative
+func maxResponseBytes(maxResponseSize int) int64 {
+	switch {
+	case maxResponseSize < 0:
+		return 0
+	case maxResponseSize == 0:
+		maxResponseSize = defaultMaxResponseSize
+	}
+
+	return int64(maxResponseSize) << 20
+}
+
+// exec runs a WarpScript on the warp10 exec endpoint, and passes the response
+// body to read as it's received. Unlike b.Client.Exec, the HTTP call is bound
+// to ctx, so it's aborted as soon as Grafana gives up on the query or the
+// datasource query timeout is reached. A failed execution is returned as an
+// *execError, a body above the maximum response size as a
+// *responseTooLargeError. The errors of read itself are left to its caller.
+func (d *Datasource) exec(ctx context.Context, script string, read func(body io.Reader)) (stats execStats, err error) {
+	ctx, span := startSpan(ctx, "exec", attributeScriptLength.Int(len(script)))
+	body := &responseReader{limit: d.maxResponse}
+	defer func() {
+		err = contextCause(ctx, err)
+		if err != nil {
+			_ = tracing.Error(span, err)
+		}
+		span.SetAttributes(attributeResponseSize.Int64(body.size))
+		span.End()
+	}()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, d.client.Host+d.client.ExecPath, strings.NewReader(script))
+	if err != nil {
+		return execStats{}, err
+	}
+	injectTraceContext(ctx, req.Header)
+
+	res, err := d.client.HTTPClient.Do(req)
+	if err != nil {
+		return execStats{}, err
+	}
+	defer res.Body.Close()
+
+	stats = newExecStats(res.Header)
+	if res.StatusCode != http.StatusOK {
+		return stats, newExecError(res)
+	}
+	if d.maxResponse > 0 && res.ContentLength > d.maxResponse {
+		return stats, &responseTooLargeError{Limit: d.maxResponse}
+	}
+
+	body.r = res.Body
+	read(body)
+	d.metrics.executed(int(body.size), stats)
+
+	return stats, body.err
+}
+
+// discardBody reads a response nobody decodes, like the one of a health check
+func discardBody(body io.Reader) {
+	_, _ = io.Copy(io.Discard, body)
+}
+
+// responseReader reads an exec response body, up to the maximum response size.
+// The body is decoded as it's read, so it's never held in memory as a whole.
+// err keeps the error of the body itself, the decoder only sees a failed read.
+type responseReader struct {
+	r io.Reader
+	// maximum size in bytes, 0 means no limit
+	limit int64
+	// bytes read so far
+	size int64
+	err  error
+}
+
+func (r *responseReader) Read(p []byte) (int, error) {
+	if r.err != nil {
+		return 0, r.err
+	}
+
+	n, err := r.r.Read(p)
+	r.size += int64(n)
+	if r.limit > 0 && r.size > r.limit {
+		r.err = &responseTooLargeError{Limit: r.limit}
+		return 0, r.err
+	}
+	if err != nil && err != io.EOF {
+		r.err = err
+	}
+
+	return n, err
+}
+
+// withQueryTimeout bounds ctx by the datasource query timeout, if any, its
+// cause being a *queryTimeoutError
+func (d *Datasource) withQueryTimeout(ctx context.Context) (context.Context, context.CancelFunc) {
+	if d.queryTimeout <= 0 {
+		return context.WithCancel(ctx)
+	}
+
+	return context.WithTimeoutCause(ctx, d.queryTimeout, &queryTimeoutError{Timeout: d.queryTimeout})
+}
+
+// contextCause returns the cause of ctx when err comes from ctx being done,
+// like a *queryTimeoutError
+func contextCause(ctx context.Context, err error) error {
+	if err != nil && ctx.Err() != nil && errors.Is(err, ctx.Err()) {
+		return context.Cause(ctx)
+	}
+
+	return err
+}
@@ -0,0 +1,110 @@
+package plugin
+
+import (
+	"context"
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestQueryTimeout(t *testing.T) {
+	release := make(chan struct{})
+	d := newTestDatasource(t, func(w http.ResponseWriter, r *http.Request) {
+		// the connection is only watched for closing once the body is consumed
+		_, _ = io.ReadAll(r.Body)
+		select {
+		case <-release:
+		case <-r.Context().Done():
+		}
+	})
+	d.queryTimeout = 50 * time.Millisecond
+	defer close(release)
+
+	res := d.query(context.Background(), backend.PluginContext{}, backend.DataQuery{
+		RefID: "A",
+		JSON:  []byte(`{"expr": "1"}`),
+	})
+
+	if res.Status != backend.StatusTimeout || res.Error == nil || res.Error.Error() != "client exec: query timed out after 50ms" {
+		t.Errorf("Expected the query timeout, got %v (%v)", res.Status, res.Error)
+	}
+
+	// the deadline of the Grafana request comes first
+	d.queryTimeout = time.Minute
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	res = d.query(ctx, backend.PluginContext{}, backend.DataQuery{
+		RefID: "A",
+		JSON:  []byte(`{"expr": "1"}`),
+	})
+
+	if res.Status != backend.StatusTimeout || res.Error == nil || res.Error.Error() != "client exec: Grafana request deadline exceeded" {
+		t.Errorf("Expected the Grafana deadline, got %v (%v)", res.Status, res.Error)
+	}
+}
+
+func TestQueryContextCancellation(t *testing.T) {
+	canceled := make(chan struct{})
+	d := newTestDatasource(t, func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.ReadAll(r.Body)
+		<-r.Context().Done()
+		close(canceled)
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		cancel()
+	}()
+
+	res := d.query(ctx, backend.PluginContext{}, backend.DataQuery{
+		RefID: "A",
+		JSON:  []byte(`{"expr": "1"}`),
+	})
+	if res.Error == nil {
+		t.Fatal("Expected an error for a canceled query")
+	}
+
+	select {
+	case <-canceled:
+	case <-time.After(time.Second):
+		t.Error("Expected the exec request to be canceled on warp10 side")
+	}
+}
+
+func TestMaxResponseSize(t *testing.T) {
+	for _, chunked := range []bool{false, true} {
+		d := newTestDatasource(t, func(w http.ResponseWriter, r *http.Request) {
+			_, _ = io.ReadAll(r.Body)
+			if chunked {
+				// no Content-Length, the size is only known once read
+				w.(http.Flusher).Flush()
+			}
+			_, _ = w.Write([]byte(`["` + strings.Repeat("x", 2<<20) + `"]`))
+		})
+		d.maxResponse = 1 << 20
+
+		res := d.query(context.Background(), backend.PluginContext{}, backend.DataQuery{
+			RefID: "A",
+			JSON:  []byte(`{"expr": "1"}`),
+		})
+
+		if res.Status != backend.StatusBadRequest || res.Error == nil || !strings.Contains(res.Error.Error(), "maximum response size of 1 MB") {
+			t.Errorf("Expected a bad request for a too large response, got %v (%v)", res.Status, res.Error)
+		}
+	}
+
+	r := &responseReader{r: strings.NewReader(`[1]`), limit: 1 << 20}
+	if body, err := io.ReadAll(r); err != nil || string(body) != `[1]` || r.size != 3 {
+		t.Errorf("Expected a small response to be read, got %q (%v)", body, err)
+	}
+	if maxResponseBytes(0) != defaultMaxResponseSize<<20 || maxResponseBytes(1) != 1<<20 {
+		t.Error("Expected the default maximum response size when not set")
+	}
+	if maxResponseBytes(-1) != 0 {
+		t.Error("Expected no maximum response size when negative")
+	}
+}
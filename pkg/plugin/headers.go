@@ -0,0 +1,83 @@
+package plugin
+
+import (
+	"context"
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/grafana/grafana-plugin-sdk-go/backend/httpclient"
+	"net/http"
+)
+
+/*
+	Static custom headers are Grafana's standard httpHeaderName<N> (jsonData) and
+	httpHeaderValue<N> (secureJsonData) settings, they are added to every exec
+	call by the SDK HTTP client. The headers below are added per request, only
+	when forwardGrafanaUser is enabled, so that a gateway in front of warp10 can
+	log who ran which query.
+*/
+
+const (
+	headerGrafanaUser  = "X-Grafana-User"
+	headerGrafanaEmail = "X-Grafana-Email"
+	headerDashboardUID = "X-Dashboard-Uid"
+	headerPanelID      = "X-Panel-Id"
+
+	auditHeadersMiddlewareName = "warp10-audit-headers"
+)
+
+// auditHeaders returns the headers identifying the Grafana user, dashboard and
+// panel behind a request. Grafana forwards the dashboard and panel of a query
+// in the request headers.
+func auditHeaders(pCtx backend.PluginContext, requestHeaders http.Header) http.Header {
+	headers := http.Header{}
+
+	if pCtx.User != nil {
+		if pCtx.User.Login != "" {
+			headers.Set(headerGrafanaUser, pCtx.User.Login)
+		}
+		if pCtx.User.Email != "" {
+			headers.Set(headerGrafanaEmail, pCtx.User.Email)
+		}
+	}
+
+	for _, key := range []string{headerDashboardUID, headerPanelID} {
+		if value := requestHeaders.Get(key); value != "" {
+			headers.Set(key, value)
+		}
+	}
+
+	return headers
+}
+
+// forwardedUser returns the login of the Grafana user forwarded to warp10, empty
+// when the user isn't forwarded. The results of a forwarded user, whose
+// permissions may differ, are never shared with other users.
+func (d *Datasource) forwardedUser(pCtx backend.PluginContext) string {
+	if !d.forwardGrafanaUser || pCtx.User == nil {
+		return ""
+	}
+
+	return pCtx.User.Login
+}
+
+// withAuditHeaders makes every exec call made under the returned context carry
+// the audit headers, when the datasource forwards the Grafana user
+func (d *Datasource) withAuditHeaders(ctx context.Context, pCtx backend.PluginContext, requestHeaders http.Header) context.Context {
+	if !d.forwardGrafanaUser {
+		return ctx
+	}
+
+	headers := auditHeaders(pCtx, requestHeaders)
+	if len(headers) == 0 {
+		return ctx
+	}
+
+	return httpclient.WithContextualMiddleware(ctx, httpclient.NamedMiddlewareFunc(auditHeadersMiddlewareName,
+		func(_ httpclient.Options, next http.RoundTripper) http.RoundTripper {
+			return httpclient.RoundTripperFunc(func(req *http.Request) (*http.Response, error) {
+				for key, values := range headers {
+					req.Header[key] = values
+				}
+				return next.RoundTrip(req)
+			})
+		}))
+}
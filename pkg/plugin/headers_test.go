@@ -0,0 +1,59 @@
+package plugin
+
+import (
+	"context"
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestExecHeaders(t *testing.T) {
+	var received http.Header
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received = r.Header.Clone()
+		_, _ = w.Write([]byte("[42]"))
+	}))
+	defer server.Close()
+
+	instance, err := NewDatasource(context.Background(), backend.DataSourceInstanceSettings{
+		JSONData:                []byte(`{"path": "` + server.URL + `", "forwardGrafanaUser": true, "httpHeaderName1": "X-Gateway-Key"}`),
+		DecryptedSecureJSONData: map[string]string{"httpHeaderValue1": "gateway-secret"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req := &backend.QueryDataRequest{
+		PluginContext: backend.PluginContext{User: &backend.User{Login: "jdoe", Email: "jdoe@example.com"}},
+		Queries:       []backend.DataQuery{{RefID: "A", JSON: []byte(`{"expr": "42"}`)}},
+	}
+	req.SetHTTPHeader(headerDashboardUID, "dashboard-uid")
+	req.SetHTTPHeader(headerPanelID, "4")
+
+	if _, err := instance.(*Datasource).QueryData(context.Background(), req); err != nil {
+		t.Fatal(err)
+	}
+
+	expectedHeaders := map[string]string{
+		"X-Gateway-Key":    "gateway-secret",
+		headerGrafanaUser:  "jdoe",
+		headerGrafanaEmail: "jdoe@example.com",
+		headerDashboardUID: "dashboard-uid",
+		headerPanelID:      "4",
+	}
+	for key, value := range expectedHeaders {
+		if received.Get(key) != value {
+			t.Errorf("Expected header %s to be %q, got %q", key, value, received.Get(key))
+		}
+	}
+}
+
+func TestExecHeadersNotForwardedByDefault(t *testing.T) {
+	d := Datasource{}
+
+	ctx := context.Background()
+	if d.withAuditHeaders(ctx, backend.PluginContext{User: &backend.User{Login: "jdoe"}}, http.Header{}) != ctx {
+		t.Error("Expected the Grafana user not to be forwarded when forwardGrafanaUser is disabled")
+	}
+}
@@ -0,0 +1,354 @@
+package plugin
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/grafana/grafana-plugin-sdk-go/backend/log"
+	"github.com/grafana/grafana-plugin-sdk-go/data"
+	"sort"
+	"sync"
+	"time"
+)
+
+/*
+	Incremental queries keep the time series they returned, so that a dashboard
+	refreshing a relative range like "now-7d" only fetches the new tail: the
+	script runs again with $start moved to the end of the previous result
+	(minus incrementalOverlap, for late datapoints), the other time variables
+	being the ones of the whole range. The new datapoints are merged by series
+	identity (class and labels, whatever the attributes), the previous
+	datapoints of the tail are replaced, and the datapoints outside the range
+	are evicted.
+
+	The results are kept by query, and by Grafana user when the user is
+	forwarded, within maxIncrementalResults and maxIncrementalBytes.
+
+	Only results made of time series can be merged, any other result is
+	returned as is and the next execution fetches the whole range again. The
+	script must select its datapoints with $start and $end for the merge to be
+	right. Merged frames are sorted by time.
+*/
+
+const (
+	// the tail starts this long before the end of the previous result
+	incrementalOverlap = time.Minute
+	// an incremental result not used for this long is forgotten
+	incrementalTTL = 10 * time.Minute
+	// maximum number of incremental results of a datasource instance
+	maxIncrementalResults = 100
+	// maximum estimated size of the incremental results of a datasource
+	// instance, see framesSize
+	maxIncrementalBytes = 128 << 20
+)
+
+// incrementalResult is the last result of an incremental query
+type incrementalResult struct {
+	frames data.Frames
+	// range covered by frames
+	from time.Time
+	to   time.Time
+	used time.Time
+	// estimated size of frames in bytes
+	size int64
+}
+
+// tailStart returns the start of the range to fetch again for timeRange, or
+// false when the result doesn't cover its beginning
+func (r *incrementalResult) tailStart(timeRange backend.TimeRange) (time.Time, bool) {
+	if r.from.After(timeRange.From) || r.to.After(timeRange.To) {
+		return time.Time{}, false
+	}
+
+	start := r.to.Add(-incrementalOverlap)
+	if !start.After(timeRange.From) {
+		return time.Time{}, false
+	}
+
+	return start, true
+}
+
+// incrementalResults are the incremental query results of a datasource
+// instance, by query. The zero value is ready to use.
+type incrementalResults struct {
+	mu      sync.Mutex
+	results map[string]*incrementalResult
+}
+
+// incrementalKey identifies an incremental query of a user, whatever its time
+// range. The range duration is part of the key as it changes $interval.
+func incrementalKey(query backend.DataQuery, wsQuery WSQuery, header string, user string) (string, error) {
+	key, err := json.Marshal(struct {
+		Header        string
+		User          string
+		Query         WSQuery
+		Window        time.Duration
+		Interval      time.Duration
+		MaxDataPoints int64
+	}{header, user, WSQuery{Expr: wsQuery.Expr, HideLabels: wsQuery.HideLabels, LegendFormat: wsQuery.LegendFormat, GeoPoints: wsQuery.GeoPoints}, query.TimeRange.To.Sub(query.TimeRange.From), query.Interval, query.MaxDataPoints})
+	if err != nil {
+		return "", err
+	}
+	hash := sha256.Sum256(key)
+
+	return hex.EncodeToString(hash[:]), nil
+}
+
+// get returns the last result of a query
+func (r *incrementalResults) get(key string) (*incrementalResult, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	result, ok := r.results[key]
+	return result, ok
+}
+
+// set stores the last result of a query, forgetting the results unused for
+// incrementalTTL and the least recently used ones above maxIncrementalResults
+// or maxIncrementalBytes. A result above maxIncrementalBytes is not stored.
+func (r *incrementalResults) set(key string, result *incrementalResult) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.results == nil {
+		r.results = map[string]*incrementalResult{}
+	}
+	delete(r.results, key)
+	if result.size > maxIncrementalBytes {
+		return
+	}
+	result.used = time.Now()
+	r.results[key] = result
+
+	var size int64
+	for k, res := range r.results {
+		if time.Since(res.used) > incrementalTTL {
+			delete(r.results, k)
+		} else {
+			size += res.size
+		}
+	}
+	for len(r.results) > maxIncrementalResults || size > maxIncrementalBytes {
+		var oldestKey string
+		var oldest time.Time
+		for k, res := range r.results {
+			if k != key && (oldestKey == "" || res.used.Before(oldest)) {
+				oldestKey, oldest = k, res.used
+			}
+		}
+		size -= r.results[oldestKey].size
+		delete(r.results, oldestKey)
+	}
+}
+
+// forget removes the last result of a query
+func (r *incrementalResults) forget(key string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	delete(r.results, key)
+}
+
+// framesSize estimates the memory used by the values of frames
+func framesSize(frames data.Frames) int64 {
+	var size int64
+	for _, frame := range frames {
+		for _, field := range frame.Fields {
+			switch field.Type() {
+			case data.FieldTypeTime:
+				// the size of a time.Time
+				size += int64(field.Len()) * 24
+			case data.FieldTypeString, data.FieldTypeNullableString:
+				for i := 0; i < field.Len(); i++ {
+					if s, ok := field.ConcreteAt(i); ok {
+						size += int64(len(s.(string)))
+					}
+				}
+				// the size of a string header
+				size += int64(field.Len()) * 16
+			default:
+				size += int64(field.Len()) * 8
+			}
+		}
+	}
+
+	return size
+}
+
+// isTimeSeries tells whether every frame is a time series
+func isTimeSeries(frames data.Frames) bool {
+	for _, frame := range frames {
+		if len(frame.Fields) < 2 || frame.Fields[0].Type() != data.FieldTypeTime {
+			return false
+		}
+	}
+
+	return true
+}
+
+// mergeTail merges the frames of a tail fetched from tailStart into the
+// previous frames, by series, keeping the datapoints of timeRange only
+func mergeTail(previous data.Frames, tail data.Frames, tailStart time.Time, timeRange backend.TimeRange) (data.Frames, error) {
+	type series struct {
+		frames []*data.Frame
+		// previous frames end before tailStart
+		ends []time.Time
+	}
+
+	var keys []string
+	bySeries := map[string]*series{}
+	add := func(frame *data.Frame, end time.Time) {
+		key := seriesKey(frame)
+		s, ok := bySeries[key]
+		if !ok {
+			s = &series{}
+			bySeries[key] = s
+			keys = append(keys, key)
+		}
+		s.frames = append(s.frames, frame)
+		s.ends = append(s.ends, end)
+	}
+	for _, frame := range previous {
+		add(frame, tailStart)
+	}
+	for _, frame := range tail {
+		add(frame, timeRange.To.Add(time.Nanosecond))
+	}
+
+	merged := make(data.Frames, 0, len(keys))
+	for _, key := range keys {
+		s := bySeries[key]
+		frame, err := mergeSeries(s.frames, s.ends, timeRange.From)
+		if err != nil {
+			return nil, err
+		}
+		if frame.Rows() > 0 {
+			merged = append(merged, frame)
+		}
+	}
+
+	return merged, nil
+}
+
+// mergeSeries merges the frames of a series, keeping the rows of frames[i]
+// between from and ends[i] (excluded), sorted by time
+func mergeSeries(frames []*data.Frame, ends []time.Time, from time.Time) (*data.Frame, error) {
+	type row struct {
+		frame int
+		index int
+		time  time.Time
+	}
+
+	last := frames[len(frames)-1]
+	var rows []row
+	for i, frame := range frames {
+		if len(frame.Fields) != len(last.Fields) {
+			return nil, fmt.Errorf("series %q changed its fields", seriesKey(frame))
+		}
+		for j, field := range frame.Fields {
+			if field.Type() != last.Fields[j].Type() {
+				return nil, fmt.Errorf("series %q changed its type", seriesKey(frame))
+			}
+		}
+
+		for index := 0; index < frame.Rows(); index++ {
+			t, ok := frame.Fields[0].At(index).(time.Time)
+			if !ok || t.Before(from) || !t.Before(ends[i]) {
+				continue
+			}
+			rows = append(rows, row{frame: i, index: index, time: t})
+		}
+	}
+	sort.SliceStable(rows, func(i, j int) bool { return rows[i].time.Before(rows[j].time) })
+
+	// the last frame carries the current name, labels and metadata
+	merged := last.EmptyCopy()
+	for j, field := range merged.Fields {
+		field.Config = last.Fields[j].Config
+		field.Extend(len(rows))
+	}
+	if last.Meta != nil {
+		merged.Meta = &data.FrameMeta{Custom: last.Meta.Custom}
+	}
+	for i, r := range rows {
+		for j, field := range frames[r.frame].Fields {
+			merged.Fields[j].Set(i, field.At(r.index))
+		}
+	}
+
+	return merged, nil
+}
+
+// responseFrames returns copies of the stored frames with their own metadata,
+// the datapoints being shared
+func responseFrames(frames data.Frames) data.Frames {
+	copies := make(data.Frames, len(frames))
+	for i, frame := range frames {
+		frameCopy := *frame
+		if frame.Meta != nil {
+			meta := *frame.Meta
+			frameCopy.Meta = &meta
+		}
+		copies[i] = &frameCopy
+	}
+
+	return copies
+}
+
+// incrementalRun is an execution of an incremental query
+type incrementalRun struct {
+	key string
+	// nil when the whole range is fetched
+	previous  *incrementalResult
+	tailStart time.Time
+}
+
+// startIncremental returns the script of an incremental query, fetching only
+// the tail of the range when the previous result covers its beginning
+func (d *Datasource) startIncremental(pCtx backend.PluginContext, query backend.DataQuery, wsQuery WSQuery) (*incrementalRun, string, error) {
+	key, err := incrementalKey(query, wsQuery, d.header, d.forwardedUser(pCtx))
+	if err != nil {
+		return nil, "", err
+	}
+
+	run := &incrementalRun{key: key, tailStart: query.TimeRange.From}
+	if previous, ok := d.incremental.get(key); ok {
+		if tailStart, ok := previous.tailStart(query.TimeRange); ok {
+			run.previous, run.tailStart = previous, tailStart
+			return run, d.buildTailScript(query, wsQuery, tailStart), nil
+		}
+	}
+
+	return run, d.buildScript(query, wsQuery), nil
+}
+
+// incrementalResponse merges the result of an incremental query with its
+// previous result, and stores it for the next execution. A result which is not
+// made of time series is returned as is. It returns false when a tail can't be
+// merged, the query must then run again over the whole range.
+func (d *Datasource) incrementalResponse(run *incrementalRun, timeRange backend.TimeRange, res backend.DataResponse) (backend.DataResponse, bool) {
+	var previousFrames data.Frames
+	if run.previous != nil {
+		previousFrames = run.previous.frames
+	}
+
+	if !isTimeSeries(res.Frames) {
+		d.incremental.forget(run.key)
+		return res, run.previous == nil
+	}
+
+	// a whole range result is sorted and trimmed like a merged one
+	frames, err := mergeTail(previousFrames, res.Frames, run.tailStart, timeRange)
+	if err != nil {
+		log.New().Warn("Incremental result not merged", "error", err)
+		d.incremental.forget(run.key)
+		return res, run.previous == nil
+	}
+
+	d.incremental.set(run.key, &incrementalResult{frames: frames, from: timeRange.From, to: timeRange.To, size: framesSize(frames)})
+	res.Frames = responseFrames(frames)
+
+	return res, true
+}
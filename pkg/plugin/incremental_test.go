@@ -0,0 +1,182 @@
+package plugin
+
+import (
+	"context"
+	"fmt"
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/grafana/grafana-plugin-sdk-go/data"
+	"io"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// timeVarRegexp reads $start or $end from a script
+var timeVarRegexp = regexp.MustCompile(`(?m)^(\d+) '(start|end)' STORE$`)
+
+func TestIncrementalQuery(t *testing.T) {
+	// a datapoint per minute
+	origin := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	var mu sync.Mutex
+	var starts []time.Time
+	var gtsType = "LONG"
+	d := newTestDatasource(t, func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		vars := map[string]int64{}
+		for _, match := range timeVarRegexp.FindAllStringSubmatch(string(body), -1) {
+			vars[match[2]], _ = strconv.ParseInt(match[1], 10, 64)
+		}
+		start, end := time.UnixMicro(vars["start"]), time.UnixMicro(vars["end"])
+
+		mu.Lock()
+		starts = append(starts, start)
+		double := gtsType == "DOUBLE"
+		// attributes are not part of the series identity
+		version := len(starts)
+		mu.Unlock()
+
+		// warp10 returns the newest datapoints first
+		var values []string
+		for ts := end.Truncate(time.Minute); !ts.Before(start); ts = ts.Add(-time.Minute) {
+			minute := int(ts.Sub(origin) / time.Minute)
+			if double {
+				values = append(values, fmt.Sprintf("[%d, %d.5]", ts.UnixMicro(), minute))
+			} else {
+				values = append(values, fmt.Sprintf("[%d, %d]", ts.UnixMicro(), minute))
+			}
+		}
+		_, _ = fmt.Fprintf(w, `[[{"c": "a", "l": {"host": "x"}, "a": {"version": "%d"}, "v": [%s]}, {"c": "b", "l": {}, "a": {}, "v": [[%d, 1]]}]]`, version, strings.Join(values, ","), end.UnixMicro())
+	})
+
+	query := func(from time.Time) []*data.Frame {
+		t.Helper()
+		res := d.query(context.Background(), backend.PluginContext{}, backend.DataQuery{
+			RefID:     "A",
+			JSON:      []byte(`{"expr": "FETCH", "incremental": true}`),
+			TimeRange: backend.TimeRange{From: from, To: from.Add(time.Hour)},
+		})
+		if res.Error != nil {
+			t.Fatal(res.Error)
+		}
+		return res.Frames
+	}
+	checkSeries := func(frames []*data.Frame, from time.Time) {
+		t.Helper()
+		if len(frames) != 2 {
+			t.Fatalf("Expected 2 series, got %d", len(frames))
+		}
+		frame := frames[0]
+		if frame.Rows() != 61 {
+			t.Fatalf("Expected 61 datapoints, got %d", frame.Rows())
+		}
+		for i := 0; i < frame.Rows(); i++ {
+			ts := frame.Fields[0].At(i).(time.Time)
+			if expected := from.Add(time.Duration(i) * time.Minute); !ts.Equal(expected) {
+				t.Fatalf("Expected datapoint %d at %v, got %v", i, expected, ts)
+			}
+		}
+		if name := frame.Fields[1].Config.DisplayNameFromDS; !strings.HasPrefix(name, "a{host=x") {
+			t.Errorf("Expected the series display name to be kept, got %q", name)
+		}
+		if frames[1].Rows() != 1 {
+			t.Errorf("Expected the datapoints outside the range to be evicted, got %d", frames[1].Rows())
+		}
+	}
+
+	from := origin.Add(24 * time.Hour)
+	checkSeries(query(from), from)
+
+	// five minutes later, only the tail is fetched
+	next := from.Add(5 * time.Minute)
+	checkSeries(query(next), next)
+	mu.Lock()
+	if expected := from.Add(time.Hour - incrementalOverlap); !starts[1].Equal(expected) {
+		t.Errorf("Expected the tail to start at %v, got %v", expected, starts[1])
+	}
+	mu.Unlock()
+
+	// a type change can't be merged, the whole range is fetched again
+	mu.Lock()
+	gtsType = "DOUBLE"
+	mu.Unlock()
+	last := next.Add(5 * time.Minute)
+	frames := query(last)
+	mu.Lock()
+	if len(starts) != 4 || !starts[3].Equal(last) {
+		t.Errorf("Expected the whole range to be fetched again, got starts %v", starts)
+	}
+	mu.Unlock()
+	if frames[0].Rows() != 61 || frames[0].Fields[1].Type() != data.FieldTypeFloat64 {
+		t.Errorf("Unexpected series after a type change: %d rows of %v", frames[0].Rows(), frames[0].Fields[1].Type())
+	}
+}
+
+func TestIncrementalQueryNotTimeSeries(t *testing.T) {
+	d := newTestDatasource(t, func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(`[42]`))
+	})
+
+	now := time.Now()
+	for i := 0; i < 2; i++ {
+		res := d.query(context.Background(), backend.PluginContext{}, backend.DataQuery{
+			RefID:     "A",
+			JSON:      []byte(`{"expr": "42", "incremental": true}`),
+			TimeRange: backend.TimeRange{From: now.Add(-time.Hour), To: now},
+		})
+		if res.Error != nil || len(res.Frames) != 1 {
+			t.Fatalf("Expected the scalar to be returned as is, got %v", res.Error)
+		}
+	}
+	if len(d.incremental.results) != 0 {
+		t.Error("Expected a scalar result not to be kept")
+	}
+}
+
+func TestIncrementalKeyUser(t *testing.T) {
+	d := newTestDatasource(t, func(w http.ResponseWriter, r *http.Request) {})
+	query := backend.DataQuery{TimeRange: backend.TimeRange{From: time.Unix(0, 0), To: time.Unix(3600, 0)}}
+	key := func(login string) string {
+		run, _, err := d.startIncremental(backend.PluginContext{User: &backend.User{Login: login}}, query, WSQuery{Expr: "FETCH"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return run.key
+	}
+
+	if key("alice") != key("bob") {
+		t.Error("Expected the users to share the results when the user is not forwarded")
+	}
+	d.forwardGrafanaUser = true
+	if key("alice") == key("bob") {
+		t.Error("Expected the results of forwarded users to be kept apart")
+	}
+}
+
+func TestIncrementalResultsLimits(t *testing.T) {
+	var r incrementalResults
+	for i := 0; i < maxIncrementalResults+10; i++ {
+		r.set(strconv.Itoa(i), &incrementalResult{size: 1})
+	}
+	if len(r.results) != maxIncrementalResults {
+		t.Errorf("Expected %d results, got %d", maxIncrementalResults, len(r.results))
+	}
+
+	r.set("large", &incrementalResult{size: maxIncrementalBytes})
+	if _, ok := r.get("large"); !ok || len(r.results) != 1 {
+		t.Errorf("Expected the least recently used results to be forgotten above the byte budget, got %d results", len(r.results))
+	}
+	r.set("too large", &incrementalResult{size: maxIncrementalBytes + 1})
+	if _, ok := r.get("too large"); ok {
+		t.Error("Expected a result above the byte budget not to be kept")
+	}
+
+	frame := data.NewFrame("", data.NewField("time", nil, []time.Time{{}, {}}), data.NewField("value", nil, []string{"ab", "c"}))
+	if size := framesSize(data.Frames{frame}); size != 2*24+2*16+3 {
+		t.Errorf("Unexpected frames size %d", size)
+	}
+}
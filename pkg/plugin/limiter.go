@@ -0,0 +1,82 @@
+package plugin
+
+import (
+	"context"
+	"github.com/grafana/grafana-plugin-sdk-go/backend/log"
+	"golang.org/x/time/rate"
+	"time"
+)
+
+// queryLimiter bounds the number of queries a datasource instance runs on
+// warp10 at the same time, and optionally the rate at which they start.
+// A nil queryLimiter doesn't limit anything.
+type queryLimiter struct {
+	// one token per in-flight query, nil when unlimited
+	slots chan struct{}
+	// token bucket, nil when there is no rate limit
+	bucket *rate.Limiter
+}
+
+// newQueryLimiter returns nil when neither limit is configured
+func newQueryLimiter(maxConcurrentQueries int, rateLimit float64, rateLimitBurst int) *queryLimiter {
+	if maxConcurrentQueries <= 0 && rateLimit <= 0 {
+		return nil
+	}
+
+	l := &queryLimiter{}
+	if maxConcurrentQueries > 0 {
+		l.slots = make(chan struct{}, maxConcurrentQueries)
+	}
+	if rateLimit > 0 {
+		if rateLimitBurst <= 0 {
+			rateLimitBurst = 1
+		}
+		l.bucket = rate.NewLimiter(rate.Limit(rateLimit), rateLimitBurst)
+	}
+
+	return l
+}
+
+// acquire waits for the query to be allowed to run, or for ctx to be done.
+// On success, release must be called once the query is over.
+func (l *queryLimiter) acquire(ctx context.Context, refID string) (release func(), err error) {
+	if l == nil {
+		return func() {}, nil
+	}
+
+	logger := log.New()
+
+	if l.bucket != nil {
+		reservation := l.bucket.Reserve()
+		if delay := reservation.Delay(); delay > 0 {
+			logger.Info("Query throttled by rate limit", "refId", refID, "delay", delay)
+
+			timer := time.NewTimer(delay)
+			select {
+			case <-timer.C:
+			case <-ctx.Done():
+				timer.Stop()
+				reservation.Cancel()
+				return nil, ctx.Err()
+			}
+		}
+	}
+
+	if l.slots == nil {
+		return func() {}, nil
+	}
+
+	select {
+	case l.slots <- struct{}{}:
+	default:
+		logger.Info("Query queued, too many queries in flight", "refId", refID, "maxConcurrentQueries", cap(l.slots))
+
+		select {
+		case l.slots <- struct{}{}:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+
+	return func() { <-l.slots }, nil
+}
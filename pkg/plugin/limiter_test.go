@@ -0,0 +1,157 @@
+package plugin
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"io"
+	"net/http"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestQueryDataMaxConcurrentQueries(t *testing.T) {
+	var inFlight, maxInFlight int32
+	d := newTestDatasource(t, func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.ReadAll(r.Body)
+
+		n := atomic.AddInt32(&inFlight, 1)
+		defer atomic.AddInt32(&inFlight, -1)
+		for {
+			m := atomic.LoadInt32(&maxInFlight)
+			if n <= m || atomic.CompareAndSwapInt32(&maxInFlight, m, n) {
+				break
+			}
+		}
+
+		time.Sleep(20 * time.Millisecond)
+		_, _ = w.Write([]byte("[42]"))
+	})
+	d.limiter = newQueryLimiter(2, 0, 0)
+
+	var queries []backend.DataQuery
+	for i := 0; i < 10; i++ {
+		queries = append(queries, backend.DataQuery{RefID: fmt.Sprintf("Q%d", i), JSON: []byte(`{"expr": "42"}`)})
+	}
+
+	resp, err := d.QueryData(context.Background(), &backend.QueryDataRequest{Queries: queries})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for refID, res := range resp.Responses {
+		if res.Error != nil {
+			t.Errorf("Unexpected error for %s: %v", refID, res.Error)
+		}
+	}
+
+	if maxInFlight > 2 {
+		t.Errorf("Expected at most 2 queries in flight, got %d", maxInFlight)
+	}
+}
+
+func TestQueryLimiterCancelWhileQueued(t *testing.T) {
+	l := newQueryLimiter(1, 0, 0)
+
+	release, err := l.acquire(context.Background(), "A")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer release()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+
+	if _, err := l.acquire(ctx, "B"); err == nil {
+		t.Error("Expected queued query to give up when its context is done")
+	}
+}
+
+func TestQueryQueuedFailure(t *testing.T) {
+	d := newTestDatasource(t, func(w http.ResponseWriter, r *http.Request) {})
+	d.limiter = newQueryLimiter(1, 0, 0)
+	release, err := d.limiter.acquire(context.Background(), "A")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer release()
+
+	query := backend.DataQuery{RefID: "B", JSON: []byte(`{"expr": "1"}`)}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if res := d.runQuery(ctx, backend.PluginContext{}, query); res.Status != backend.StatusTimeout {
+		t.Errorf("Expected a queued query past its deadline to time out, got %v (%v)", res.Status, res.Error)
+	}
+
+	ctx, cancel = context.WithCancel(context.Background())
+	cancel()
+	if res := d.runQuery(ctx, backend.PluginContext{}, query); res.Status == backend.StatusTimeout || !errors.Is(res.Error, context.Canceled) {
+		t.Errorf("Expected a cancelled queued query to keep its cancellation, got %v (%v)", res.Status, res.Error)
+	}
+}
+
+func TestQueryLimiterRateLimit(t *testing.T) {
+	l := newQueryLimiter(0, 20, 1)
+
+	start := time.Now()
+	for i := 0; i < 3; i++ {
+		release, err := l.acquire(context.Background(), "A")
+		if err != nil {
+			t.Fatal(err)
+		}
+		release()
+	}
+
+	// the first query uses the burst, the two others wait 50ms each
+	if elapsed := time.Since(start); elapsed < 90*time.Millisecond {
+		t.Errorf("Expected rate limit to delay queries, took %v", elapsed)
+	}
+}
+
+func TestQueryLimiterCoalescedQueries(t *testing.T) {
+	var execs atomic.Int32
+	unblock := make(chan struct{})
+	d := newTestDatasource(t, func(w http.ResponseWriter, r *http.Request) {
+		execs.Add(1)
+		<-unblock
+		_, _ = w.Write([]byte("[42]"))
+	})
+	d.limiter = newQueryLimiter(1, 0, 0)
+
+	waiters := func() int {
+		d.execs.mu.Lock()
+		defer d.execs.mu.Unlock()
+
+		n := 0
+		for _, call := range d.execs.calls {
+			n += call.waiters
+		}
+		return n
+	}
+
+	responses := make(chan backend.DataResponse, 3)
+	for i := 0; i < 3; i++ {
+		go func() {
+			responses <- d.runQuery(context.Background(), backend.PluginContext{}, backend.DataQuery{RefID: "A", JSON: []byte(`{"expr": "42"}`)})
+		}()
+	}
+	for waiters() < 3 {
+		time.Sleep(time.Millisecond)
+	}
+	if len(d.limiter.slots) != 1 {
+		t.Errorf("Expected the coalesced queries to hold a single slot, got %d", len(d.limiter.slots))
+	}
+	close(unblock)
+
+	for i := 0; i < 3; i++ {
+		if res := <-responses; res.Error != nil {
+			t.Errorf("Unexpected error: %v", res.Error)
+		}
+	}
+	if execs.Load() != 1 {
+		t.Errorf("Expected a single execution, got %d", execs.Load())
+	}
+}
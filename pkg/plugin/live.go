@@ -0,0 +1,351 @@
+package plugin
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/grafana/grafana-plugin-sdk-go/backend/log"
+	"github.com/grafana/grafana-plugin-sdk-go/data"
+	"github.com/grafana/grafana-plugin-sdk-go/live"
+	"strings"
+	"sync"
+	"time"
+)
+
+/*
+	Live queries are executed again by the backend on an interval, over a sliding
+	[now-window, now] range, the window being the length of the panel time range.
+	Only the datapoints newer than the ones already sent are pushed to Grafana
+	Live, so only time series frames are streamed. Mobius queries (see
+	mobius.go) share the same registration and channels.
+
+	QueryData returns the first result with the channel of the query in the frame
+	metadata, and the frontend subscribes to it. The channel path is a hash of the
+	query, so that every panel running the same query shares the same channel:
+	Grafana runs a single RunStream per channel, whatever its number of
+	subscribers. A subscriber joining a running stream only has the result of
+	its own QueryData call, so the next result of the stream is sent over the
+	whole window instead of the new datapoints only.
+*/
+
+const (
+	// prefix of the channel path of a live query
+	liveChannelPrefix = "live/"
+	// interval of a live query when not set
+	defaultLiveInterval = 10 * time.Second
+	// shortest interval of a live query
+	minLiveInterval = time.Second
+	// window of a live query without time range
+	defaultLiveWindow = time.Hour
+	// a registered live query nobody subscribed to is forgotten after this delay
+	liveQueryTTL = 10 * time.Minute
+)
+
+// liveQuery is a query streamed to a Grafana Live channel
+type liveQuery struct {
+	// query executed on each tick, its time range being replaced by the window
+	query    backend.DataQuery
+	window   time.Duration
+	interval time.Duration
+	// end of the time range returned by QueryData, only newer datapoints are sent
+	since time.Time
+
+	registered time.Time
+	running    bool
+	// a subscriber joined the running stream, see streamSince
+	joined bool
+}
+
+// liveQueries are the live queries of a datasource instance, by channel path.
+// The zero value is ready to use.
+type liveQueries struct {
+	mu      sync.Mutex
+	queries map[string]*liveQuery
+}
+
+// register stores a live query and returns its channel path. A query already
+// streamed is left as is, its new subscriber being handled by join.
+func (l *liveQueries) register(query backend.DataQuery, wsQuery WSQuery) (string, error) {
+	window := query.TimeRange.To.Sub(query.TimeRange.From)
+	if window <= 0 {
+		window = defaultLiveWindow
+	}
+	interval := time.Duration(wsQuery.LiveInterval) * time.Second
+	if interval <= 0 {
+		interval = defaultLiveInterval
+	}
+	if interval < minLiveInterval {
+		interval = minLiveInterval
+	}
+
+	prefix := liveChannelPrefix
+	if wsQuery.Mobius {
+		prefix = mobiusChannelPrefix
+	}
+
+	// the query executed on each tick must not register itself again, nor
+	// return a previous result
+	wsQuery.Live, wsQuery.Mobius = false, false
+	wsQuery.NoCache, wsQuery.Incremental = true, false
+	queryJSON, err := json.Marshal(wsQuery)
+	if err != nil {
+		return "", err
+	}
+
+	// the refId and the time range don't change the stream
+	key, err := json.Marshal(struct {
+		Query         WSQuery
+		Window        time.Duration
+		Interval      time.Duration
+		MaxDataPoints int64
+	}{WSQuery{Expr: wsQuery.Expr, HideLabels: wsQuery.HideLabels, LegendFormat: wsQuery.LegendFormat, GeoPoints: wsQuery.GeoPoints}, window, interval, query.MaxDataPoints})
+	if err != nil {
+		return "", err
+	}
+	hash := sha256.Sum256(key)
+	path := prefix + hex.EncodeToString(hash[:])
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	if l.queries == nil {
+		l.queries = map[string]*liveQuery{}
+	}
+	for p, q := range l.queries {
+		if !q.running && now.Sub(q.registered) > liveQueryTTL {
+			delete(l.queries, p)
+		}
+	}
+
+	if q, ok := l.queries[path]; ok && q.running {
+		q.registered = now
+		return path, nil
+	}
+
+	query.JSON = queryJSON
+	l.queries[path] = &liveQuery{
+		query:      query,
+		window:     window,
+		interval:   interval,
+		since:      query.TimeRange.To,
+		registered: now,
+	}
+
+	return path, nil
+}
+
+// get returns the live query of a channel path
+func (l *liveQueries) get(path string) (*liveQuery, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	q, ok := l.queries[path]
+	return q, ok
+}
+
+// join accepts a subscriber of a channel, and returns false for an unknown
+// channel
+func (l *liveQueries) join(path string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	q, ok := l.queries[path]
+	if ok && q.running {
+		q.joined = true
+	}
+	return ok
+}
+
+// streamSince returns the time after which the datapoints of a series not sent
+// yet are new. Once a subscriber joined the stream, lastSent is cleared and
+// every series is sent again over the whole window.
+func (l *liveQueries) streamSince(q *liveQuery, lastSent map[string]time.Time) time.Time {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if !q.joined {
+		return q.since
+	}
+	q.joined = false
+	clear(lastSent)
+	return time.Time{}
+}
+
+// setRunning marks a live query as streamed, so that it's never forgotten
+func (l *liveQueries) setRunning(path string, running bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if q, ok := l.queries[path]; ok {
+		q.running = running
+		q.registered = time.Now()
+	}
+}
+
+// setLiveChannel registers a live query and sets its channel on every frame
+func (d *Datasource) setLiveChannel(pCtx backend.PluginContext, query backend.DataQuery, wsQuery WSQuery, res *backend.DataResponse) error {
+	if pCtx.DataSourceInstanceSettings == nil {
+		return fmt.Errorf("live query without datasource")
+	}
+
+	path, err := d.live.register(query, wsQuery)
+	if err != nil {
+		return err
+	}
+
+	channel := live.Channel{
+		Scope:     live.ScopeDatasource,
+		Namespace: pCtx.DataSourceInstanceSettings.UID,
+		Path:      path,
+	}.String()
+
+	if len(res.Frames) == 0 {
+		res.Frames = data.Frames{data.NewFrame("")}
+	}
+	for _, frame := range res.Frames {
+		if frame.Meta == nil {
+			frame.Meta = &data.FrameMeta{}
+		}
+		frame.Meta.Channel = channel
+	}
+
+	return nil
+}
+
+// SubscribeStream accepts the subscriptions to the channels of registered live queries
+func (d *Datasource) SubscribeStream(_ context.Context, req *backend.SubscribeStreamRequest) (*backend.SubscribeStreamResponse, error) {
+	if !d.live.join(req.Path) {
+		return &backend.SubscribeStreamResponse{Status: backend.SubscribeStreamStatusNotFound}, nil
+	}
+
+	return &backend.SubscribeStreamResponse{Status: backend.SubscribeStreamStatusOK}, nil
+}
+
+// PublishStream refuses every publication, live channels are fed by the backend only
+func (d *Datasource) PublishStream(_ context.Context, _ *backend.PublishStreamRequest) (*backend.PublishStreamResponse, error) {
+	return &backend.PublishStreamResponse{Status: backend.PublishStreamStatusPermissionDenied}, nil
+}
+
+// RunStream executes a live query on its interval, or forwards the results of
+// a Mobius query, until the last subscriber leaves
+func (d *Datasource) RunStream(ctx context.Context, req *backend.RunStreamRequest, sender *backend.StreamSender) error {
+	q, ok := d.live.get(req.Path)
+	if !ok {
+		return fmt.Errorf("unknown live query: %s", req.Path)
+	}
+
+	d.live.setRunning(req.Path, true)
+	defer d.live.setRunning(req.Path, false)
+
+	if strings.HasPrefix(req.Path, mobiusChannelPrefix) {
+		return d.runMobiusStream(ctx, req.Path, q, sender)
+	}
+
+	logger := log.New()
+	logger.Debug("Live query started", "path", req.Path, "interval", q.interval, "window", q.window)
+
+	// end of the last datapoint sent, by series
+	lastSent := map[string]time.Time{}
+
+	ticker := time.NewTicker(q.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			logger.Debug("Live query stopped", "path", req.Path)
+			return nil
+		case <-ticker.C:
+			if err := d.runLiveQuery(ctx, req.PluginContext, q, lastSent, sender); err != nil {
+				logger.Warn("Live query failed", "path", req.Path, "error", err)
+			}
+		}
+	}
+}
+
+// runLiveQuery executes a live query over the window ending now, and sends the
+// datapoints newer than lastSent, see streamSince
+func (d *Datasource) runLiveQuery(ctx context.Context, pCtx backend.PluginContext, q *liveQuery, lastSent map[string]time.Time, sender *backend.StreamSender) error {
+	now := time.Now()
+	query := q.query
+	query.TimeRange = backend.TimeRange{From: now.Add(-q.window), To: now}
+
+	res := d.runQuery(ctx, pCtx, query)
+	if res.Error != nil {
+		return res.Error
+	}
+
+	return sendNewRows(res.Frames, d.live.streamSince(q, lastSent), lastSent, sender)
+}
+
+// sendNewRows sends the rows of the time series frames newer than the last
+// ones sent for their series, or than since for a new series
+func sendNewRows(frames data.Frames, since time.Time, lastSent map[string]time.Time, sender *backend.StreamSender) error {
+	for _, frame := range frames {
+		if len(frame.Fields) == 0 || frame.Fields[0].Type() != data.FieldTypeTime {
+			continue
+		}
+
+		key := seriesKey(frame)
+		after, ok := lastSent[key]
+		if !ok {
+			after = since
+		}
+
+		newFrame, last := rowsAfter(frame, after)
+		if newFrame == nil {
+			continue
+		}
+		if err := sender.SendFrame(newFrame, data.IncludeAll); err != nil {
+			return err
+		}
+		lastSent[key] = last
+	}
+
+	return nil
+}
+
+// seriesKey identifies the series of a frame: the class and labels of its GTS,
+// or its fields names and labels for the other frames
+func seriesKey(frame *data.Frame) string {
+	if frame.Meta != nil {
+		if custom, ok := frame.Meta.Custom.(FrameMetaCustom); ok && custom.Series != "" {
+			return custom.Series
+		}
+	}
+
+	key := frame.Name
+	for _, field := range frame.Fields {
+		key += "|" + field.Name + field.Labels.String()
+	}
+
+	return key
+}
+
+// rowsAfter returns a copy of the frame rows with a time after since, and the
+// latest time, or nil when there is none
+func rowsAfter(frame *data.Frame, since time.Time) (*data.Frame, time.Time) {
+	newFrame := frame.EmptyCopy()
+	last := since
+	for i := 0; i < frame.Rows(); i++ {
+		t, ok := frame.Fields[0].At(i).(time.Time)
+		if !ok || !t.After(since) {
+			continue
+		}
+
+		newFrame.AppendRow(frame.RowCopy(i)...)
+		if t.After(last) {
+			last = t
+		}
+	}
+
+	if newFrame.Rows() == 0 {
+		return nil, since
+	}
+
+	return newFrame, last
+}
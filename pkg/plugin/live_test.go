@@ -0,0 +1,134 @@
+package plugin
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/grafana/grafana-plugin-sdk-go/data"
+	"github.com/grafana/grafana-plugin-sdk-go/live"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// packetRecorder records the frames sent to a stream
+type packetRecorder struct {
+	mu     sync.Mutex
+	frames []*data.Frame
+}
+
+func (r *packetRecorder) Send(packet *backend.StreamPacket) error {
+	var frame data.Frame
+	if err := json.Unmarshal(packet.Data, &frame); err != nil {
+		return err
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.frames = append(r.frames, &frame)
+	return nil
+}
+
+func TestLiveQuery(t *testing.T) {
+	var mu sync.Mutex
+	var timestamps []int64
+	d := newTestDatasource(t, func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+
+		values := make([]string, len(timestamps))
+		for i, ts := range timestamps {
+			values[i] = fmt.Sprintf("[%d, %d]", ts, i)
+		}
+		_, _ = fmt.Fprintf(w, `[[{"c": "live", "l": {}, "a": {}, "v": [%s]}]]`, strings.Join(values, ","))
+	})
+
+	now := time.Now()
+	pCtx := backend.PluginContext{DataSourceInstanceSettings: &backend.DataSourceInstanceSettings{UID: "live-uid"}}
+	query := backend.DataQuery{
+		RefID:     "A",
+		JSON:      []byte(`{"expr": "FETCH", "live": true, "liveInterval": 5}`),
+		TimeRange: backend.TimeRange{From: now.Add(-time.Hour), To: now},
+	}
+
+	mu.Lock()
+	timestamps = []int64{now.Add(-time.Minute).UnixMicro()}
+	mu.Unlock()
+
+	res := d.query(context.Background(), pCtx, query)
+	if res.Error != nil {
+		t.Fatal(res.Error)
+	}
+
+	channel, err := live.ParseChannel(res.Frames[0].Meta.Channel)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if channel.Scope != live.ScopeDatasource || channel.Namespace != "live-uid" || !strings.HasPrefix(channel.Path, liveChannelPrefix) {
+		t.Errorf("Unexpected live channel %q", res.Frames[0].Meta.Channel)
+	}
+
+	// the same query from another panel shares the channel
+	other := query
+	other.RefID = "B"
+	if res := d.query(context.Background(), pCtx, other); res.Frames[0].Meta.Channel != channel.String() {
+		t.Errorf("Expected the same query to share the channel %q, got %q", channel.String(), res.Frames[0].Meta.Channel)
+	}
+
+	subscription, _ := d.SubscribeStream(context.Background(), &backend.SubscribeStreamRequest{Path: channel.Path})
+	if subscription.Status != backend.SubscribeStreamStatusOK {
+		t.Errorf("Expected subscription to be accepted, got %v", subscription.Status)
+	}
+	subscription, _ = d.SubscribeStream(context.Background(), &backend.SubscribeStreamRequest{Path: liveChannelPrefix + "unknown"})
+	if subscription.Status != backend.SubscribeStreamStatusNotFound {
+		t.Errorf("Expected unknown channel to be refused, got %v", subscription.Status)
+	}
+
+	q, _ := d.live.get(channel.Path)
+	if q.interval != 5*time.Second || q.window != time.Hour {
+		t.Errorf("Unexpected live interval %v and window %v", q.interval, q.window)
+	}
+
+	recorder := &packetRecorder{}
+	sender := backend.NewStreamSender(recorder)
+	lastSent := map[string]time.Time{}
+
+	// two new datapoints, then nothing new, then one more
+	mu.Lock()
+	timestamps = append(timestamps, time.Now().Add(time.Millisecond).UnixMicro(), time.Now().Add(2*time.Millisecond).UnixMicro())
+	mu.Unlock()
+	for _, more := range []int{0, 0, 1} {
+		if more > 0 {
+			mu.Lock()
+			timestamps = append(timestamps, time.Now().Add(time.Second).UnixMicro())
+			mu.Unlock()
+		}
+		if err := d.runLiveQuery(context.Background(), pCtx, q, lastSent, sender); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if len(recorder.frames) != 2 {
+		t.Fatalf("Expected 2 frames to be sent, got %d", len(recorder.frames))
+	}
+	if recorder.frames[0].Rows() != 2 || recorder.frames[1].Rows() != 1 {
+		t.Errorf("Expected only the new datapoints to be sent, got %d and %d rows", recorder.frames[0].Rows(), recorder.frames[1].Rows())
+	}
+
+	// a subscriber joining the running stream gets the whole window once
+	d.live.setRunning(channel.Path, true)
+	if subscription, _ := d.SubscribeStream(context.Background(), &backend.SubscribeStreamRequest{Path: channel.Path}); subscription.Status != backend.SubscribeStreamStatusOK {
+		t.Fatalf("Expected subscription to be accepted, got %v", subscription.Status)
+	}
+	for i := 0; i < 2; i++ {
+		if err := d.runLiveQuery(context.Background(), pCtx, q, lastSent, sender); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(recorder.frames) != 3 || recorder.frames[2].Rows() != 4 {
+		t.Errorf("Expected the whole window to be sent once after a join, got %d frames", len(recorder.frames))
+	}
+}
@@ -0,0 +1,216 @@
+package plugin
+
+import (
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"time"
+)
+
+/*
+	Collectors are registered on the Prometheus default registry, which Grafana
+	scrapes through its plugin metrics endpoint
+	(/api/plugins/clevercloud-warp10-datasource/metrics). Every metric is labeled
+	with the datasource UID so that each warp10 cluster is monitored separately.
+*/
+
+const (
+	metricsNamespace = "warp10_datasource"
+	labelUID         = "datasource_uid"
+)
+
+// Parsed shapes of a stack level
+const (
+	shapeTable       = "table"
+	shapeGTSList     = "gts_list"
+	shapeArray       = "array"
+	shapeScalar      = "scalar"
+	shapeUnsupported = "unsupported"
+)
+
+var (
+	queryDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "query_duration_seconds",
+		Help:      "Duration of the queries, by outcome (ok, error, timeout).",
+		Buckets:   []float64{.01, .05, .1, .25, .5, 1, 2.5, 5, 10, 30, 60},
+	}, []string{labelUID, "outcome"})
+
+	queriesInFlight = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "queries_in_flight",
+		Help:      "Number of queries in progress, the ones waiting for the limiter included.",
+	}, []string{labelUID})
+
+	parsedStackLevels = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "parsed_stack_levels_total",
+		Help:      "Number of warp10 stack levels parsed, by shape (table, gts_list, array, scalar, unsupported).",
+	}, []string{labelUID, "shape"})
+
+	parserErrors = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "parser_errors_total",
+		Help:      "Number of warp10 stack levels of a supported shape that failed to be converted to frames.",
+	}, []string{labelUID, "shape"})
+
+	receivedBytes = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "received_bytes_total",
+		Help:      "Number of bytes received from the warp10 exec endpoint.",
+	}, []string{labelUID})
+
+	execOperations = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "exec_operations_total",
+		Help:      "Number of WarpScript operations reported by warp10 (X-Warp10-Ops).",
+	}, []string{labelUID})
+
+	fetchedDatapoints = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "fetched_datapoints_total",
+		Help:      "Number of datapoints read from storage reported by warp10 (X-Warp10-Fetched).",
+	}, []string{labelUID})
+
+	execElapsed = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "exec_elapsed_seconds",
+		Help:      "Execution time of the WarpScripts reported by warp10 (X-Warp10-Elapsed).",
+		Buckets:   []float64{.01, .05, .1, .25, .5, 1, 2.5, 5, 10, 30, 60},
+	}, []string{labelUID})
+
+	cacheLookups = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "cache_lookups_total",
+		Help:      "Number of query cache lookups, by result (hit, miss).",
+	}, []string{labelUID, "result"})
+
+	coalescedExecutions = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "coalesced_executions_total",
+		Help:      "Number of executions served by an identical execution already in flight.",
+	}, []string{labelUID})
+
+	healthCheckFailures = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "health_check_failures_total",
+		Help:      "Number of failed health checks.",
+	}, []string{labelUID})
+)
+
+// datasourceMetrics records the metrics of a datasource instance. A nil
+// datasourceMetrics doesn't record anything.
+type datasourceMetrics struct {
+	uid string
+}
+
+func newDatasourceMetrics(uid string) *datasourceMetrics {
+	return &datasourceMetrics{uid: uid}
+}
+
+// deleter is a metric vector labeled with the datasource UID
+type deleter interface {
+	DeletePartialMatch(labels prometheus.Labels) int
+}
+
+// collectors are the metric vectors of the datasources
+var collectors = []deleter{
+	queryDuration, queriesInFlight, parsedStackLevels, parserErrors, receivedBytes, execOperations,
+	fetchedDatapoints, execElapsed, cacheLookups, coalescedExecutions, healthCheckFailures,
+}
+
+// dispose deletes the metrics of the datasource, so that a deleted datasource
+// isn't exported anymore
+func (m *datasourceMetrics) dispose() {
+	if m == nil {
+		return
+	}
+
+	for _, collector := range collectors {
+		collector.DeletePartialMatch(prometheus.Labels{labelUID: m.uid})
+	}
+}
+
+// queryStarted counts an in-flight query, the returned function must be called
+// with the query response once it's over
+func (m *datasourceMetrics) queryStarted() func(res backend.DataResponse) {
+	if m == nil {
+		return func(backend.DataResponse) {}
+	}
+
+	start := time.Now()
+	queriesInFlight.WithLabelValues(m.uid).Inc()
+
+	return func(res backend.DataResponse) {
+		queriesInFlight.WithLabelValues(m.uid).Dec()
+		queryDuration.WithLabelValues(m.uid, queryOutcome(res)).Observe(time.Since(start).Seconds())
+	}
+}
+
+// queryOutcome returns the outcome label of a query response
+func queryOutcome(res backend.DataResponse) string {
+	switch {
+	case res.Error == nil:
+		return "ok"
+	case res.Status == backend.StatusTimeout:
+		return "timeout"
+	default:
+		return "error"
+	}
+}
+
+// parsed counts a parsed stack level, and its conversion error if any
+func (m *datasourceMetrics) parsed(shape string, err error) {
+	if m == nil {
+		return
+	}
+
+	parsedStackLevels.WithLabelValues(m.uid, shape).Inc()
+	if err != nil && shape != shapeUnsupported {
+		parserErrors.WithLabelValues(m.uid, shape).Inc()
+	}
+}
+
+// executed counts the response size and the statistics of an exec call: its
+// elapsed time, operations and fetched datapoints
+func (m *datasourceMetrics) executed(size int, stats execStats) {
+	if m == nil {
+		return
+	}
+
+	receivedBytes.WithLabelValues(m.uid).Add(float64(size))
+	execOperations.WithLabelValues(m.uid).Add(float64(stats.Ops))
+	fetchedDatapoints.WithLabelValues(m.uid).Add(float64(stats.Fetched))
+	execElapsed.WithLabelValues(m.uid).Observe(stats.Elapsed.Seconds())
+}
+
+// cacheLookup counts a query cache lookup
+func (m *datasourceMetrics) cacheLookup(hit bool) {
+	if m == nil {
+		return
+	}
+
+	result := "miss"
+	if hit {
+		result = "hit"
+	}
+	cacheLookups.WithLabelValues(m.uid, result).Inc()
+}
+
+// coalesced counts an execution served by an identical one in flight
+func (m *datasourceMetrics) coalesced() {
+	if m == nil {
+		return
+	}
+
+	coalescedExecutions.WithLabelValues(m.uid).Inc()
+}
+
+// healthCheckFailed counts a failed health check
+func (m *datasourceMetrics) healthCheckFailed() {
+	if m == nil {
+		return
+	}
+
+	healthCheckFailures.WithLabelValues(m.uid).Inc()
+}
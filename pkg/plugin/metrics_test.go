@@ -0,0 +1,97 @@
+package plugin
+
+import (
+	"context"
+	"fmt"
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	b "github.com/miton18/go-warp10/base"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestQueryMetrics(t *testing.T) {
+	const body = `[{"columns": [{"text": "a"}], "rows": [[1]]}, {"k": "v"}, 42]`
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set(b.HeaderOperations, "7")
+		w.Header().Set(b.HeaderFetched, "100")
+		w.Header().Set(b.HeaderElapsed, "2500000000")
+		_, _ = w.Write([]byte(body))
+	}))
+	defer server.Close()
+
+	// the collectors are global, each run has its own series
+	uid := fmt.Sprintf("metrics-test-%d", time.Now().UnixNano())
+	instance, err := NewDatasource(context.Background(), backend.DataSourceInstanceSettings{
+		UID:      uid,
+		JSONData: []byte(`{"path": "` + server.URL + `"}`),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = instance.(*Datasource).QueryData(context.Background(), &backend.QueryDataRequest{
+		Queries: []backend.DataQuery{{RefID: "A", JSON: []byte(`{"expr": "42"}`)}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got := map[string]float64{
+		"table":       testutil.ToFloat64(parsedStackLevels.WithLabelValues(uid, shapeTable)),
+		"unsupported": testutil.ToFloat64(parsedStackLevels.WithLabelValues(uid, shapeUnsupported)),
+		"scalar":      testutil.ToFloat64(parsedStackLevels.WithLabelValues(uid, shapeScalar)),
+		"operations":  testutil.ToFloat64(execOperations.WithLabelValues(uid)),
+		"fetched":     testutil.ToFloat64(fetchedDatapoints.WithLabelValues(uid)),
+		"bytes":       testutil.ToFloat64(receivedBytes.WithLabelValues(uid)),
+		"in flight":   testutil.ToFloat64(queriesInFlight.WithLabelValues(uid)),
+	}
+	for name, value := range map[string]float64{
+		"table":       1,
+		"unsupported": 1,
+		"scalar":      1,
+		"operations":  7,
+		"fetched":     100,
+		"bytes":       float64(len(body)),
+		"in flight":   0,
+	} {
+		if got[name] != value {
+			t.Errorf("Expected %s metric to be %v, got %v", name, value, got[name])
+		}
+	}
+
+	if count := testutil.CollectAndCount(queryDuration, "warp10_datasource_query_duration_seconds"); count == 0 {
+		t.Error("Expected the query duration to be observed")
+	}
+
+	elapsed := strings.ReplaceAll(`
+		# HELP warp10_datasource_exec_elapsed_seconds Execution time of the WarpScripts reported by warp10 (X-Warp10-Elapsed).
+		# TYPE warp10_datasource_exec_elapsed_seconds histogram
+		warp10_datasource_exec_elapsed_seconds_bucket{datasource_uid="metrics-test",le="0.01"} 0
+		warp10_datasource_exec_elapsed_seconds_bucket{datasource_uid="metrics-test",le="0.05"} 0
+		warp10_datasource_exec_elapsed_seconds_bucket{datasource_uid="metrics-test",le="0.1"} 0
+		warp10_datasource_exec_elapsed_seconds_bucket{datasource_uid="metrics-test",le="0.25"} 0
+		warp10_datasource_exec_elapsed_seconds_bucket{datasource_uid="metrics-test",le="0.5"} 0
+		warp10_datasource_exec_elapsed_seconds_bucket{datasource_uid="metrics-test",le="1"} 0
+		warp10_datasource_exec_elapsed_seconds_bucket{datasource_uid="metrics-test",le="2.5"} 1
+		warp10_datasource_exec_elapsed_seconds_bucket{datasource_uid="metrics-test",le="5"} 1
+		warp10_datasource_exec_elapsed_seconds_bucket{datasource_uid="metrics-test",le="10"} 1
+		warp10_datasource_exec_elapsed_seconds_bucket{datasource_uid="metrics-test",le="30"} 1
+		warp10_datasource_exec_elapsed_seconds_bucket{datasource_uid="metrics-test",le="60"} 1
+		warp10_datasource_exec_elapsed_seconds_bucket{datasource_uid="metrics-test",le="+Inf"} 1
+		warp10_datasource_exec_elapsed_seconds_sum{datasource_uid="metrics-test"} 2.5
+		warp10_datasource_exec_elapsed_seconds_count{datasource_uid="metrics-test"} 1
+	`, "metrics-test", uid)
+	if err := testutil.CollectAndCompare(execElapsed.WithLabelValues(uid).(prometheus.Histogram), strings.NewReader(elapsed), "warp10_datasource_exec_elapsed_seconds"); err != nil {
+		t.Errorf("Expected the Warp 10 elapsed time to be observed: %v", err)
+	}
+
+	instance.(*Datasource).Dispose()
+	if execElapsed.DeleteLabelValues(uid) || parsedStackLevels.DeleteLabelValues(uid, shapeTable) {
+		t.Error("Expected the metrics of the datasource to be deleted on dispose")
+	}
+}
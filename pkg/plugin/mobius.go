@@ -0,0 +1,235 @@
+package plugin
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/gorilla/websocket"
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/grafana/grafana-plugin-sdk-go/backend/log"
+	"net/http"
+	"runtime/debug"
+	"sync"
+	"time"
+)
+
+/*
+	Mobius queries are executed by warp10 itself: the backend sends the
+	WarpScript to the /api/v0/mobius WebSocket endpoint as a macro with a period,
+	and warp10 pushes the stack of every execution. Like live queries, their
+	channel path is a hash of the query. The backend opens a single Mobius
+	connection per script, shared by every stream of the channel, and closes it
+	when the last one leaves. The connection is opened again with an exponential
+	backoff when it fails.
+
+	The script runs inside the Mobius macro, with the datasource constants,
+	macros and token. Its time variables are computed by each execution, $end
+	being NOW and $start the panel window before it.
+*/
+
+const (
+	// warp10 Mobius WebSocket endpoint
+	mobiusPath = "/api/v0/mobius"
+	// prefix of the channel path of a Mobius query
+	mobiusChannelPrefix = "mobius/"
+	// pushed stacks waiting to be converted by a slow stream are dropped
+	mobiusBufferSize = 16
+)
+
+// delays between two Mobius connection attempts, vars for the tests
+var (
+	mobiusMinBackoff = time.Second
+	mobiusMaxBackoff = time.Minute
+)
+
+// mobiusDialer opens the Mobius connections of a datasource instance
+type mobiusDialer struct {
+	dialer *websocket.Dialer
+	url    string
+	header http.Header
+	// maximum size of a pushed stack in bytes, 0 means no limit
+	readLimit int64
+}
+
+// mobiusHub shares the Mobius connections of a datasource instance, by channel
+// path. The zero value is ready to use.
+type mobiusHub struct {
+	mu          sync.Mutex
+	connections map[string]*mobiusConnection
+}
+
+// mobiusConnection forwards the stacks pushed by warp10 to its subscribers
+type mobiusConnection struct {
+	cancel      context.CancelFunc
+	subscribers map[chan []byte]struct{}
+}
+
+// subscribe returns the stacks pushed for a script, the connection being opened
+// by the first subscriber. unsubscribe closes it when called by the last one.
+func (h *mobiusHub) subscribe(path string, script string, dialer *mobiusDialer) (stacks <-chan []byte, unsubscribe func()) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if h.connections == nil {
+		h.connections = map[string]*mobiusConnection{}
+	}
+
+	conn, ok := h.connections[path]
+	if !ok {
+		ctx, cancel := context.WithCancel(context.Background())
+		conn = &mobiusConnection{cancel: cancel, subscribers: map[chan []byte]struct{}{}}
+		h.connections[path] = conn
+		go dialer.run(ctx, path, script, func(stack []byte) { h.broadcast(conn, stack) })
+	}
+
+	subscriber := make(chan []byte, mobiusBufferSize)
+	conn.subscribers[subscriber] = struct{}{}
+
+	return subscriber, func() {
+		h.mu.Lock()
+		defer h.mu.Unlock()
+
+		delete(conn.subscribers, subscriber)
+		if len(conn.subscribers) == 0 {
+			conn.cancel()
+			delete(h.connections, path)
+		}
+	}
+}
+
+// broadcast sends a pushed stack to every subscriber of a connection
+func (h *mobiusHub) broadcast(conn *mobiusConnection, stack []byte) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	for subscriber := range conn.subscribers {
+		select {
+		case subscriber <- stack:
+		default:
+			log.New().Warn("Mobius stack dropped, stream too slow")
+		}
+	}
+}
+
+// run keeps a Mobius connection open until ctx is done
+func (m *mobiusDialer) run(ctx context.Context, path string, script string, push func([]byte)) {
+	logger := log.New()
+	backoff := mobiusMinBackoff
+
+	for {
+		received, err := m.listen(ctx, script, push)
+		if ctx.Err() != nil {
+			logger.Debug("Mobius connection closed", "path", path)
+			return
+		}
+		if received {
+			backoff = mobiusMinBackoff
+		}
+		logger.Warn("Mobius connection lost", "path", path, "error", err, "retry", backoff)
+
+		timer := time.NewTimer(backoff)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+
+		backoff *= 2
+		if backoff > mobiusMaxBackoff {
+			backoff = mobiusMaxBackoff
+		}
+	}
+}
+
+// listen opens a Mobius connection, sends the script and pushes every stack
+// received until the connection fails or ctx is done
+func (m *mobiusDialer) listen(ctx context.Context, script string, push func([]byte)) (received bool, err error) {
+	conn, _, err := m.dialer.DialContext(ctx, m.url, m.header)
+	if err != nil {
+		return false, err
+	}
+	defer conn.Close()
+	if m.readLimit > 0 {
+		conn.SetReadLimit(m.readLimit)
+	}
+
+	// unblock ReadMessage once ctx is done
+	stop := context.AfterFunc(ctx, func() { _ = conn.Close() })
+	defer stop()
+
+	if err := conn.WriteMessage(websocket.TextMessage, []byte(script)); err != nil {
+		return false, err
+	}
+
+	for {
+		_, message, err := conn.ReadMessage()
+		if err != nil {
+			return received, err
+		}
+		received = true
+		push(message)
+	}
+}
+
+// mobiusScript wraps a query in the macro executed by Mobius every interval,
+// its time variables sliding with each execution
+func (d *Datasource) mobiusScript(q *liveQuery, wsQuery WSQuery) string {
+	return fmt.Sprintf("<%%\n%s%s%s\n%%>\n%d EVERY", slidingTimeVarsHeader(q.query, q.window), d.header, wsQuery.Expr, q.interval.Milliseconds())
+}
+
+// runMobiusStream forwards the time series pushed by Mobius for a query, until
+// the stream is over
+func (d *Datasource) runMobiusStream(ctx context.Context, path string, q *liveQuery, sender *backend.StreamSender) error {
+	if d.mobius == nil {
+		return fmt.Errorf("mobius is not configured")
+	}
+
+	var wsQuery WSQuery
+	if err := json.Unmarshal(q.query.JSON, &wsQuery); err != nil {
+		return err
+	}
+	opts := parseOptions{
+		hideLabels:       wsQuery.HideLabels,
+		legendFormat:     wsQuery.LegendFormat,
+		attributesPrefix: d.attributesPrefix,
+		geoPoints:        wsQuery.GeoPoints,
+		metrics:          d.metrics,
+	}
+
+	stacks, unsubscribe := d.mobiusHub.subscribe(path, d.mobiusScript(q, wsQuery), d.mobius)
+	defer unsubscribe()
+
+	logger := log.New()
+	lastSent := map[string]time.Time{}
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case stack := <-stacks:
+			res, err := decodeMobiusStack(ctx, stack, opts)
+			if err != nil {
+				logger.Warn("Mobius stack not converted", "path", path, "error", d.redact(err.Error()))
+				continue
+			}
+			if err := sendNewRows(res.Frames, d.live.streamSince(q, lastSent), lastSent, sender); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// decodeMobiusStack converts a stack pushed by Mobius. A panic is turned into a
+// parsing error of this stack only, so that the stream goes on with the next
+// one.
+func decodeMobiusStack(ctx context.Context, stack []byte, opts parseOptions) (res backend.DataResponse, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			log.New().Error("Mobius stack parsing panicked", "panic", r, "stack", string(debug.Stack()))
+			res, err = backend.DataResponse{}, fmt.Errorf("stack parsing error: %v", r)
+		}
+	}()
+
+	return decodeStack(ctx, bytes.NewReader(stack), opts)
+}
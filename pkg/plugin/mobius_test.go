@@ -0,0 +1,158 @@
+package plugin
+
+import (
+	"context"
+	"fmt"
+	"github.com/gorilla/websocket"
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/grafana/grafana-plugin-sdk-go/live"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestMobiusStream(t *testing.T) {
+	defer func(backoff time.Duration) { mobiusMinBackoff = backoff }(mobiusMinBackoff)
+	mobiusMinBackoff = 10 * time.Millisecond
+
+	var mu sync.Mutex
+	var scripts []string
+	closed := make(chan struct{}, 2)
+
+	upgrader := websocket.Upgrader{}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/v0/exec", func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(`[]`))
+	})
+	mux.HandleFunc(mobiusPath, func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer func() {
+			_ = conn.Close()
+			closed <- struct{}{}
+		}()
+
+		_, script, err := conn.ReadMessage()
+		if err != nil {
+			return
+		}
+
+		mu.Lock()
+		scripts = append(scripts, string(script))
+		attempt := len(scripts)
+		mu.Unlock()
+
+		stack := fmt.Sprintf(`[[{"c": "mobius", "l": {}, "a": {}, "v": [[%d, %d]]}]]`, time.Now().Add(time.Second).UnixMicro(), attempt)
+		if err := conn.WriteMessage(websocket.TextMessage, []byte(stack)); err != nil {
+			return
+		}
+
+		// the first connection is lost, the second one stays open
+		if attempt > 1 {
+			_, _, _ = conn.ReadMessage()
+		}
+	})
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	instance, err := NewDatasource(context.Background(), backend.DataSourceInstanceSettings{
+		UID:      "mobius-uid",
+		JSONData: []byte(`{"path": "` + server.URL + `"}`),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	d := instance.(*Datasource)
+
+	now := time.Now()
+	pCtx := backend.PluginContext{DataSourceInstanceSettings: &backend.DataSourceInstanceSettings{UID: "mobius-uid"}}
+	res := d.query(context.Background(), pCtx, backend.DataQuery{
+		RefID:     "A",
+		JSON:      []byte(`{"expr": "NOW", "mobius": true, "liveInterval": 2}`),
+		TimeRange: backend.TimeRange{From: now.Add(-time.Hour), To: now},
+	})
+	if res.Error != nil {
+		t.Fatal(res.Error)
+	}
+
+	channel, err := live.ParseChannel(res.Frames[0].Meta.Channel)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(channel.Path, mobiusChannelPrefix) {
+		t.Fatalf("Expected a Mobius channel, got %q", channel.Path)
+	}
+
+	recorder := &packetRecorder{}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() {
+		done <- d.RunStream(ctx, &backend.RunStreamRequest{PluginContext: pCtx, Path: channel.Path}, backend.NewStreamSender(recorder))
+	}()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		recorder.mu.Lock()
+		sent := len(recorder.frames)
+		recorder.mu.Unlock()
+		if sent >= 2 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected a frame per Mobius connection, got %d", sent)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	cancel()
+	if err := <-done; err != nil {
+		t.Error(err)
+	}
+
+	// both connections are closed once the last subscriber leaves
+	for i := 0; i < 2; i++ {
+		select {
+		case <-closed:
+		case <-time.After(5 * time.Second):
+			t.Fatal("Expected the Mobius connection to be closed")
+		}
+	}
+
+	d.mobiusHub.mu.Lock()
+	if len(d.mobiusHub.connections) != 0 {
+		t.Errorf("Expected no Mobius connection left, got %d", len(d.mobiusHub.connections))
+	}
+	d.mobiusHub.mu.Unlock()
+
+	mu.Lock()
+	defer mu.Unlock()
+	if !strings.HasPrefix(scripts[0], "<%") || !strings.Contains(scripts[0], "NOW") || !strings.HasSuffix(scripts[0], "2000 EVERY") {
+		t.Errorf("Unexpected Mobius script %q", scripts[0])
+	}
+	if !strings.Contains(scripts[0], "NOW 'end' STORE\n$end 3600000000 - 'start' STORE\n") {
+		t.Errorf("Expected the Mobius script to compute its time variables, got %q", scripts[0])
+	}
+}
+
+func TestDecodeMobiusStackMalformed(t *testing.T) {
+	for _, stack := range []string{
+		``,
+		`[[{"c": "mobius", "v": [[1, 2]`,
+		`[{"c": "mobius", "l": [], "v": [[1, 2]]}]`,
+		`[[42, {"c": "mobius"}], {"columns": 1, "rows": {}}] 42`,
+	} {
+		if _, err := decodeMobiusStack(context.Background(), []byte(stack), parseOptions{}); err == nil {
+			t.Errorf("Expected malformed stack %q to fail", stack)
+		}
+	}
+
+	res, err := decodeMobiusStack(context.Background(), []byte(`[{"c": "mobius", "v": [[null, {}], [1, [2]], ["x"]]}]`), parseOptions{})
+	if err != nil || res.Frames[0].Rows() != 0 || len(res.Frames[0].Meta.Notices) != 1 {
+		t.Errorf("Expected malformed datapoints to be ignored with a notice, got %v", err)
+	}
+}
@@ -0,0 +1,169 @@
+package plugin
+
+import (
+	"fmt"
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"strings"
+	"time"
+)
+
+/*
+	The backend owns the WarpScript header of every query it executes (time
+	variables, datasource constants and macros), so that alert rules, recorded
+	queries and public API calls see the same variables as dashboards. The frontend only builds this header itself in direct mode, where
+	the request never reaches the backend. Queries sent through the proxy are
+	always injected here, exactly once.
+*/
+
+// isoTimeLayout matches the JavaScript Date.toISOString() output used by the frontend
+const isoTimeLayout = "2006-01-02T15:04:05.000Z"
+
+const (
+	// secureJsonData key of the warp10 token
+	secureTokenKey = "token"
+	// WarpScript variable holding the token when tokenVariable is not set
+	defaultTokenVariable = "token"
+	// replaces the token in every message leaving the backend
+	redactedToken = "********"
+)
+
+// warpScriptEscaper percent-encodes the characters that can't appear as is in a
+// WarpScript string constant, warp10 URL-decodes string constants when parsing
+var warpScriptEscaper = strings.NewReplacer(
+	"%", "%25",
+	"'", "%27",
+	"\n", "%0A",
+	"\r", "%0D",
+)
+
+// buildScript prepends the backend header to the user WarpScript
+func (d *Datasource) buildScript(query backend.DataQuery, wsQuery WSQuery) string {
+	return d.prelude(query) + wsQuery.Expr
+}
+
+// buildTailScript prepends the backend header to the user WarpScript, $start
+// and $startISO being moved to start. The other time variables are the ones of
+// the whole query range, and the header has the same number of lines.
+func (d *Datasource) buildTailScript(query backend.DataQuery, wsQuery WSQuery, start time.Time) string {
+	return timeVarsHeaderFrom(query, start) + d.header + wsQuery.Expr
+}
+
+// prelude returns the backend header of a query, every line ending with a newline
+func (d *Datasource) prelude(query backend.DataQuery) string {
+	return timeVarsHeader(query) + d.header
+}
+
+// timeVarsHeader stores $start, $end, $startISO, $endISO, $interval, $__interval
+// and $__interval_ms, all durations being expressed in microseconds like warp10
+// timestamps (except $__interval_ms).
+func timeVarsHeader(query backend.DataQuery) string {
+	return timeVarsHeaderFrom(query, query.TimeRange.From)
+}
+
+// timeVarsHeaderFrom is timeVarsHeader with $start and $startISO set to start
+func timeVarsHeaderFrom(query backend.DataQuery, start time.Time) string {
+	from := query.TimeRange.From
+	to := query.TimeRange.To
+
+	end := to.UnixMicro()
+	interval := end - from.UnixMicro()
+
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "%d 'start' STORE\n", start.UnixMicro())
+	fmt.Fprintf(&sb, "'%s' 'startISO' STORE\n", start.UTC().Format(isoTimeLayout))
+	fmt.Fprintf(&sb, "%d 'end' STORE\n", end)
+	fmt.Fprintf(&sb, "'%s' 'endISO' STORE\n", to.UTC().Format(isoTimeLayout))
+	writeIntervals(&sb, query, interval)
+
+	return sb.String()
+}
+
+// slidingTimeVarsHeader stores the variables of timeVarsHeader over a window
+// ending when warp10 runs the script, for the scripts it runs again by itself
+// like the Mobius macros
+func slidingTimeVarsHeader(query backend.DataQuery, window time.Duration) string {
+	interval := window.Microseconds()
+
+	var sb strings.Builder
+	sb.WriteString("NOW 'end' STORE\n")
+	fmt.Fprintf(&sb, "$end %d - 'start' STORE\n", interval)
+	sb.WriteString("$start ISO8601 'startISO' STORE\n")
+	sb.WriteString("$end ISO8601 'endISO' STORE\n")
+	writeIntervals(&sb, query, interval)
+
+	return sb.String()
+}
+
+// writeIntervals stores $interval, the width of the query range, and the step
+// of its datapoints in $__interval and $__interval_ms
+func writeIntervals(sb *strings.Builder, query backend.DataQuery, interval int64) {
+	var stepInterval int64
+	switch {
+	case query.MaxDataPoints > 0:
+		stepInterval = interval / query.MaxDataPoints
+	case query.Interval > 0:
+		stepInterval = query.Interval.Microseconds()
+	default:
+		stepInterval = interval
+	}
+
+	fmt.Fprintf(sb, "%d 'interval' STORE\n", interval)
+	fmt.Fprintf(sb, "%d '__interval' STORE\n", stepInterval)
+	fmt.Fprintf(sb, "%d '__interval_ms' STORE\n", stepInterval/int64(time.Millisecond/time.Microsecond))
+}
+
+// tokenHeader stores the secure token under the configured variable name
+func tokenHeader(variable string, token string) string {
+	if token == "" {
+		return ""
+	}
+
+	return fmt.Sprintf("%s %s STORE\n", warpScriptString(token), warpScriptString(variable))
+}
+
+// redact hides the secure token, raw or escaped, from a message sent back to
+// Grafana or written to the logs
+func (d *Datasource) redact(message string) string {
+	if d.token == "" {
+		return message
+	}
+
+	return strings.NewReplacer(
+		d.token, redactedToken,
+		warpScriptEscaper.Replace(d.token), redactedToken,
+	).Replace(message)
+}
+
+// constantsHeader stores the datasource constants, then the datasource macros,
+// mirroring computeGrafanaContext from the frontend.
+func constantsHeader(constants []ConstProp, macros []ConstProp) string {
+	var sb strings.Builder
+	for _, c := range constants {
+		fmt.Fprintf(&sb, "%s %s STORE\n", warpScriptValue(c.Value), warpScriptString(c.Name))
+	}
+	for _, m := range macros {
+		fmt.Fprintf(&sb, "%s %s STORE\n", warpScriptValue(m.Value), warpScriptString(m.Name))
+	}
+	sb.WriteString("LINEON\n")
+
+	return sb.String()
+}
+
+// warpScriptValue returns a macro (<% ... %>) as is, and quotes anything else
+func warpScriptValue(value string) string {
+	if value == "" {
+		return "NULL"
+	}
+
+	trimmed := strings.TrimSpace(value)
+	if strings.HasPrefix(trimmed, "<%") && strings.HasSuffix(trimmed, "%>") {
+		return trimmed
+	}
+
+	return warpScriptString(value)
+}
+
+// warpScriptString returns s as a single quoted WarpScript string constant
+func warpScriptString(s string) string {
+	return "'" + warpScriptEscaper.Replace(s) + "'"
+}
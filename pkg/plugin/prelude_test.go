@@ -0,0 +1,106 @@
+package plugin
+
+import (
+	"context"
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTimeVarsHeader(t *testing.T) {
+	from := time.Date(2021, 4, 30, 12, 0, 0, 0, time.UTC)
+	to := from.Add(time.Hour)
+
+	header := timeVarsHeader(backend.DataQuery{
+		TimeRange:     backend.TimeRange{From: from, To: to},
+		MaxDataPoints: 100,
+	})
+
+	expectedHeader := "1619784000000000 'start' STORE\n" +
+		"'2021-04-30T12:00:00.000Z' 'startISO' STORE\n" +
+		"1619787600000000 'end' STORE\n" +
+		"'2021-04-30T13:00:00.000Z' 'endISO' STORE\n" +
+		"3600000000 'interval' STORE\n" +
+		"36000000 '__interval' STORE\n" +
+		"36000 '__interval_ms' STORE\n"
+
+	if header != expectedHeader {
+		t.Errorf("Wrong time header. Expected %q got %q", expectedHeader, header)
+	}
+}
+
+func TestTimeVarsHeaderWithoutMaxDataPoints(t *testing.T) {
+	from := time.Date(2021, 4, 30, 12, 0, 0, 0, time.UTC)
+
+	header := timeVarsHeader(backend.DataQuery{
+		TimeRange: backend.TimeRange{From: from, To: from.Add(time.Hour)},
+		Interval:  time.Minute,
+	})
+
+	expectedInterval := "60000000 '__interval' STORE\n60000 '__interval_ms' STORE\n"
+	if !strings.HasSuffix(header, expectedInterval) {
+		t.Errorf("Expected header to end with %q, got %q", expectedInterval, header)
+	}
+}
+
+func TestConstantsHeader(t *testing.T) {
+	header := constantsHeader(
+		[]ConstProp{
+			{Name: "ReadToken", Value: "abc'def"},
+			{Name: "percent", Value: "100%\nsure"},
+			{Name: "empty", Value: ""},
+		},
+		[]ConstProp{
+			{Name: "dropfirst", Value: "<% 1 DROP %>"},
+		},
+	)
+
+	expectedHeader := "'abc%27def' 'ReadToken' STORE\n" +
+		"'100%25%0Asure' 'percent' STORE\n" +
+		"NULL 'empty' STORE\n" +
+		"<% 1 DROP %> 'dropfirst' STORE\n" +
+		"LINEON\n"
+
+	if header != expectedHeader {
+		t.Errorf("Wrong constants header. Expected %q got %q", expectedHeader, header)
+	}
+}
+
+func TestNewDatasourceConstants(t *testing.T) {
+	instance, err := NewDatasource(context.Background(), backend.DataSourceInstanceSettings{
+		JSONData: []byte(`{"path": "http://localhost:8080", "const": [{"name": "ReadToken", "value": "abc"}], "macro": [{"name": "m", "value": "<% 1 %>"}]}`),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	d := instance.(*Datasource)
+	script := d.buildScript(backend.DataQuery{}, WSQuery{Expr: "$ReadToken @m"})
+
+	expectedSuffix := "'abc' 'ReadToken' STORE\n<% 1 %> 'm' STORE\nLINEON\n$ReadToken @m"
+	if !strings.HasSuffix(script, expectedSuffix) {
+		t.Errorf("Expected script to end with %q, got %q", expectedSuffix, script)
+	}
+}
+
+func TestNewDatasourceSecureToken(t *testing.T) {
+	instance, err := NewDatasource(context.Background(), backend.DataSourceInstanceSettings{
+		JSONData:                []byte(`{"path": "http://localhost:8080", "tokenVariable": "ReadToken"}`),
+		DecryptedSecureJSONData: map[string]string{"token": "s3cr'et"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	d := instance.(*Datasource)
+	if !strings.Contains(d.header, "'s3cr%27et' 'ReadToken' STORE\n") {
+		t.Errorf("Expected token to be stored in $ReadToken, got %q", d.header)
+	}
+
+	message := d.redact("Exception at 's3cr%27et' 'ReadToken' STORE, token s3cr'et")
+	expectedMessage := "Exception at '********' 'ReadToken' STORE, token ********"
+	if message != expectedMessage {
+		t.Errorf("Wrong redacted message. Expected %q got %q", expectedMessage, message)
+	}
+}
@@ -0,0 +1,229 @@
+package plugin
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/grafana/grafana-plugin-sdk-go/backend/log"
+	"github.com/grafana/grafana-plugin-sdk-go/backend/resource/httpadapter"
+	"go.opentelemetry.io/otel/trace"
+	"io"
+	"net/http"
+	"runtime/debug"
+	"time"
+)
+
+/*
+	Template variable queries are executed through the /variables resource
+	rather than the panel query path: the script runs with the backend header
+	like any other query, and the resulting stack is converted to variable
+	options by the backend.
+
+	Every stack level gives options, from the top of the stack:
+	  - a list gives an option per element, text and value being the element
+	  - a map gives an option per entry, the key being the text
+	  - any other value gives a single option
+	Lists are flattened, nested maps and lists in a map are JSON encoded.
+*/
+
+// variableRefID identifies variable queries in the logs and the limiter
+const variableRefID = "variables"
+
+// VariableQuery is the body of a /variables resource call
+type VariableQuery struct {
+	Expr string `json:"expr"`
+	// time range in milliseconds, the last hour when not set
+	From int64 `json:"from"`
+	To   int64 `json:"to"`
+	// number of lines of the header prepended to Expr by the frontend
+	HeaderLines int `json:"headerLines"`
+}
+
+// variableOption is a template variable option, as expected by metricFindQuery
+type variableOption struct {
+	Text  string `json:"text"`
+	Value string `json:"value"`
+}
+
+// CallResource handles the resource calls of the frontend
+func (d *Datasource) CallResource(ctx context.Context, req *backend.CallResourceRequest, sender backend.CallResourceResponseSender) error {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/variables", d.handleVariables)
+
+	return httpadapter.New(mux).CallResource(ctx, req, sender)
+}
+
+// handleVariables executes a variable query and returns its options
+func (d *Datasource) handleVariables(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeResourceError(w, http.StatusMethodNotAllowed, "variables: POST expected")
+		return
+	}
+
+	var variableQuery VariableQuery
+	if err := json.NewDecoder(r.Body).Decode(&variableQuery); err != nil {
+		writeResourceError(w, http.StatusBadRequest, fmt.Sprintf("json unmarshal: %v", err))
+		return
+	}
+
+	pCtx := backend.PluginConfigFromContext(r.Context())
+	ctx := d.withAuditHeaders(r.Context(), pCtx, r.Header)
+	options, res := d.variables(ctx, pCtx, variableQuery)
+	if res.Error != nil {
+		status := res.Status
+		if status == 0 {
+			status = backend.StatusUnknown
+		}
+		writeResourceError(w, int(status), res.Error.Error())
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(options); err != nil {
+		log.New().Error("Variables not sent", "error", err)
+	}
+}
+
+// variables executes a variable query, a failure being reported as the error
+// response of a query. A panic is turned into an internal error, like in
+// runQuery.
+func (d *Datasource) variables(ctx context.Context, pCtx backend.PluginContext, variableQuery VariableQuery) (options []variableOption, res backend.DataResponse) {
+	ctx, span := startSpan(ctx, "variables", attributeRefID.String(variableRefID))
+	defer func() {
+		if r := recover(); r != nil {
+			log.New().Error("Variable query panicked", "panic", d.redact(fmt.Sprint(r)), "stack", string(debug.Stack()))
+			options, res = nil, backend.ErrDataResponse(backend.StatusInternal, d.redact(fmt.Sprintf("variables panicked: %v", r)))
+		}
+		endQuerySpan(span, res)
+	}()
+
+	to := time.Now()
+	if variableQuery.To > 0 {
+		to = time.UnixMilli(variableQuery.To)
+	}
+	from := to.Add(-time.Hour)
+	if variableQuery.From > 0 {
+		from = time.UnixMilli(variableQuery.From)
+	}
+	query := backend.DataQuery{
+		RefID:     variableRefID,
+		TimeRange: backend.TimeRange{From: from, To: to},
+	}
+
+	script := d.buildScript(query, WSQuery{Expr: variableQuery.Expr})
+	trace.SpanFromContext(ctx).SetAttributes(attributeScriptLength.Int(len(script)))
+
+	result, _, err := d.sharedExec(ctx, pCtx, query.RefID, "variables\x00"+script, script, func(body io.Reader) interface{} {
+		options, err := parseVariables(body)
+		return decodedVariables{options: options, err: err}
+	})
+	if err != nil {
+		return nil, d.execFailure(query, variableQuery.HeaderLines, err)
+	}
+
+	decoded := result.(decodedVariables)
+	if decoded.err != nil {
+		return nil, backend.ErrDataResponse(backend.StatusInternal, decoded.err.Error())
+	}
+
+	return decoded.options, backend.DataResponse{}
+}
+
+// decodedVariables is the result of parseVariables on an exec response, shared
+// by the coalesced executions
+type decodedVariables struct {
+	options []variableOption
+	err     error
+}
+
+// parseVariables converts a warp10 stack read from r to variable options,
+// preserving the order of the map entries
+func parseVariables(r io.Reader) ([]variableOption, error) {
+	dec := json.NewDecoder(r)
+	dec.UseNumber()
+
+	tok, err := dec.Token()
+	if err != nil {
+		return nil, fmt.Errorf("variables: %w", err)
+	}
+	if tok != json.Delim('[') {
+		return nil, fmt.Errorf("variables: stack expected, got %v", tok)
+	}
+
+	options := []variableOption{}
+	for dec.More() {
+		if options, err = readVariableLevel(dec, options); err != nil {
+			return nil, fmt.Errorf("variables: %w", err)
+		}
+	}
+
+	return options, nil
+}
+
+// readVariableLevel appends the options of the next value of dec
+func readVariableLevel(dec *json.Decoder, options []variableOption) ([]variableOption, error) {
+	tok, err := dec.Token()
+	if err != nil {
+		return nil, err
+	}
+
+	switch tok {
+	case json.Delim('['):
+		for dec.More() {
+			if options, err = readVariableLevel(dec, options); err != nil {
+				return nil, err
+			}
+		}
+		_, err = dec.Token()
+		return options, err
+	case json.Delim('{'):
+		for dec.More() {
+			key, err := dec.Token()
+			if err != nil {
+				return nil, err
+			}
+			var value json.RawMessage
+			if err := dec.Decode(&value); err != nil {
+				return nil, err
+			}
+			options = append(options, variableOption{Text: fmt.Sprint(key), Value: variableValue(value)})
+		}
+		_, err = dec.Token()
+		return options, err
+	case nil:
+		// a NULL has no text
+		return options, nil
+	default:
+		text := fmt.Sprint(tok)
+		return append(options, variableOption{Text: text, Value: text}), nil
+	}
+}
+
+// variableValue returns the text of a map value, nested maps and lists being
+// kept as compact JSON
+func variableValue(value json.RawMessage) string {
+	var text string
+	if err := json.Unmarshal(value, &text); err == nil {
+		return text
+	}
+	if string(value) == "null" {
+		return ""
+	}
+
+	var compact bytes.Buffer
+	if err := json.Compact(&compact, value); err != nil {
+		return string(value)
+	}
+
+	return compact.String()
+}
+
+// writeResourceError sends an error to the frontend, like Grafana does for its
+// own resources
+func writeResourceError(w http.ResponseWriter, status int, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(map[string]string{"message": message})
+}
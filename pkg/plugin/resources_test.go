@@ -0,0 +1,123 @@
+package plugin
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	b "github.com/miton18/go-warp10/base"
+	"io"
+	"net/http"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// resourceRecorder records the response of a resource call
+type resourceRecorder struct {
+	response *backend.CallResourceResponse
+}
+
+func (r *resourceRecorder) Send(res *backend.CallResourceResponse) error {
+	if r.response == nil {
+		r.response = res
+	} else {
+		r.response.Body = append(r.response.Body, res.Body...)
+	}
+	return nil
+}
+
+func TestParseVariables(t *testing.T) {
+	tests := []struct {
+		name     string
+		stack    string
+		expected []variableOption
+	}{
+		{"list", `[["a", "b"]]`, []variableOption{{"a", "a"}, {"b", "b"}}},
+		{"map", `[{"b": "1", "a": 2}]`, []variableOption{{"b", "1"}, {"a", "2"}}},
+		{"loose values", `["a", 42, 1.5, true, null]`, []variableOption{{"a", "a"}, {"42", "42"}, {"1.5", "1.5"}, {"true", "true"}}},
+		{"nested", `[[["a"], {"k": {"x": [1, 2]}}], 10000000000000001]`, []variableOption{{"a", "a"}, {"k", `{"x":[1,2]}`}, {"10000000000000001", "10000000000000001"}}},
+		{"empty", `[]`, []variableOption{}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			options, err := parseVariables(strings.NewReader(test.stack))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(options, test.expected) {
+				t.Errorf("Expected %v, got %v", test.expected, options)
+			}
+		})
+	}
+
+	if _, err := parseVariables(strings.NewReader(`{"a": 1}`)); err == nil {
+		t.Error("Expected an error for a result which is not a stack")
+	}
+}
+
+func TestCallResourceVariables(t *testing.T) {
+	var script string
+	d := newTestDatasource(t, func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		script = string(body)
+		if strings.Contains(script, "FAIL") {
+			w.Header().Set(b.HeaderErrorMessage, "Exception at '=>FAIL<=' in section [TOP] (Unknown function 'FAIL')")
+			w.Header().Set(b.HeaderErrorLine, strconv.Itoa(strings.Count(script, "\n")+1))
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		_, _ = w.Write([]byte(`[{"host-1": "h1"}, ["x"]]`))
+	})
+
+	call := func(method string, body string) *backend.CallResourceResponse {
+		recorder := &resourceRecorder{}
+		err := d.CallResource(context.Background(), &backend.CallResourceRequest{
+			Path:   "variables",
+			Method: method,
+			URL:    "variables",
+			Body:   []byte(body),
+		}, recorder)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return recorder.response
+	}
+
+	res := call(http.MethodPost, `{"expr": "'h' 'hosts' STORE", "from": 1700000000000, "to": 1700003600000}`)
+	if res.Status != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d: %s", res.Status, res.Body)
+	}
+	var options []variableOption
+	if err := json.Unmarshal(res.Body, &options); err != nil {
+		t.Fatal(err)
+	}
+	if expected := []variableOption{{"host-1", "h1"}, {"x", "x"}}; !reflect.DeepEqual(options, expected) {
+		t.Errorf("Expected %v, got %v", expected, options)
+	}
+	if !strings.Contains(script, "1700000000000000 'start' STORE") || !strings.HasSuffix(script, "'h' 'hosts' STORE") {
+		t.Errorf("Expected the variable query to run with the backend header, got %q", script)
+	}
+
+	for _, body := range []string{`{"expr": "FAIL"}`, `{"expr": "'a' 'v' STORE\nFAIL", "headerLines": 1}`} {
+		res = call(http.MethodPost, body)
+		if res.Status != http.StatusBadRequest || !strings.Contains(string(res.Body), "line 1") {
+			t.Errorf("Expected the WarpScript error at the editor line, got %d: %s", res.Status, res.Body)
+		}
+	}
+
+	if res := call(http.MethodGet, ``); res.Status != http.StatusMethodNotAllowed {
+		t.Errorf("Expected status 405, got %d", res.Status)
+	}
+	if res := call(http.MethodPost, `{`); res.Status != http.StatusBadRequest {
+		t.Errorf("Expected status 400, got %d", res.Status)
+	}
+
+	// without client, the exec call panics
+	d = &Datasource{token: "secret"}
+	res = call(http.MethodPost, `{"expr": "'secret'"}`)
+	if res.Status != http.StatusInternalServerError || !strings.Contains(string(res.Body), "variables panicked") || strings.Contains(string(res.Body), "secret") {
+		t.Errorf("Expected a redacted internal error, got %d: %s", res.Status, res.Body)
+	}
+}
@@ -0,0 +1,59 @@
+package plugin
+
+import (
+	"github.com/grafana/grafana-plugin-sdk-go/data"
+	b "github.com/miton18/go-warp10/base"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// execStats are the statistics warp10 returns with every exec call
+type execStats struct {
+	// X-Warp10-Elapsed, sent by warp10 in nanoseconds
+	Elapsed time.Duration
+	// X-Warp10-Ops, number of WarpScript operations
+	Ops int64
+	// X-Warp10-Fetched, number of datapoints read from storage
+	Fetched int64
+}
+
+// newExecStats reads the statistics headers of an exec call, a missing or
+// invalid header is left to 0
+func newExecStats(header http.Header) execStats {
+	readInt := func(key string) int64 {
+		value, _ := strconv.ParseInt(header.Get(key), 10, 64)
+		return value
+	}
+
+	return execStats{
+		Elapsed: time.Duration(readInt(b.HeaderElapsed)),
+		Ops:     readInt(b.HeaderOperations),
+		Fetched: readInt(b.HeaderFetched),
+	}
+}
+
+// queryStats returns the statistics shown in the Grafana query inspector
+func queryStats(stats execStats, scriptSize int, frameCount int) []data.QueryStat {
+	stat := func(displayName string, unit string, value float64) data.QueryStat {
+		return data.QueryStat{FieldConfig: data.FieldConfig{DisplayName: displayName, Unit: unit}, Value: value}
+	}
+
+	return []data.QueryStat{
+		stat("Warp 10 elapsed", "ms", float64(stats.Elapsed)/float64(time.Millisecond)),
+		stat("Warp 10 operations", "short", float64(stats.Ops)),
+		stat("Warp 10 fetched datapoints", "short", float64(stats.Fetched)),
+		stat("Script size", "bytes", float64(scriptSize)),
+		stat("Frames", "short", float64(frameCount)),
+	}
+}
+
+// setQueryStats sets the query statistics on every frame
+func setQueryStats(frames data.Frames, stats []data.QueryStat) {
+	for _, frame := range frames {
+		if frame.Meta == nil {
+			frame.Meta = &data.FrameMeta{}
+		}
+		frame.Meta.Stats = stats
+	}
+}
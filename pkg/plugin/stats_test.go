@@ -0,0 +1,52 @@
+package plugin
+
+import (
+	"context"
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	b "github.com/miton18/go-warp10/base"
+	"net/http"
+	"testing"
+)
+
+func TestQueryStats(t *testing.T) {
+	d := newTestDatasource(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set(b.HeaderElapsed, "2500000")
+		w.Header().Set(b.HeaderOperations, "12")
+		w.Header().Set(b.HeaderFetched, "3000")
+		_, _ = w.Write([]byte(`[42, "up"]`))
+	})
+
+	res := d.query(context.Background(), backend.PluginContext{}, backend.DataQuery{
+		RefID: "A",
+		JSON:  []byte(`{"expr": "'up' 42"}`),
+	})
+	if res.Error != nil {
+		t.Fatal(res.Error)
+	}
+
+	if len(res.Frames) != 2 {
+		t.Fatalf("Expected 2 frames, got %d", len(res.Frames))
+	}
+
+	expected := map[string]float64{
+		"Warp 10 elapsed":            2.5,
+		"Warp 10 operations":         12,
+		"Warp 10 fetched datapoints": 3000,
+		"Frames":                     2,
+	}
+	for _, frame := range res.Frames {
+		stats := map[string]float64{}
+		for _, stat := range frame.Meta.Stats {
+			stats[stat.DisplayName] = stat.Value
+		}
+
+		for name, value := range expected {
+			if stats[name] != value {
+				t.Errorf("Expected stat %q to be %v, got %v", name, value, stats[name])
+			}
+		}
+		if stats["Script size"] <= float64(len("'up' 42")) {
+			t.Errorf("Expected script size to include the prelude, got %v", stats["Script size"])
+		}
+	}
+}
@@ -0,0 +1,51 @@
+package plugin
+
+import (
+	"context"
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/grafana/grafana-plugin-sdk-go/backend/tracing"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+	"net/http"
+)
+
+/*
+	Spans are created with the SDK default tracer, which Grafana configures when
+	tracing is enabled for plugins, and is a no-op otherwise:
+	QueryData > query > exec (> the SDK HTTP client span)
+	              \> "decode table", "decode gts list", "decode array",
+	                 "decode scalar" or "decode unsupported", one per stack
+	                 level (see decodeStack)
+*/
+
+// Span attributes
+const (
+	attributeRefID        = attribute.Key("warp10.ref_id")
+	attributeQueries      = attribute.Key("warp10.queries")
+	attributeScriptLength = attribute.Key("warp10.script_length")
+	attributeResponseSize = attribute.Key("warp10.response_size")
+	attributeStackDepth   = attribute.Key("warp10.stack_depth")
+	attributeShape        = attribute.Key("warp10.shape")
+	attributeFrames       = attribute.Key("warp10.frames")
+)
+
+// startSpan starts a span of the SDK default tracer
+func startSpan(ctx context.Context, name string, attributes ...attribute.KeyValue) (context.Context, trace.Span) {
+	return tracing.DefaultTracer().Start(ctx, name, trace.WithAttributes(attributes...))
+}
+
+// endQuerySpan records the error of a query response, if any, and ends the span
+func endQuerySpan(span trace.Span, res backend.DataResponse) {
+	if res.Error != nil {
+		_ = tracing.Error(span, res.Error)
+	}
+	span.SetAttributes(attributeFrames.Int(len(res.Frames)))
+	span.End()
+}
+
+// injectTraceContext adds the traceparent header of the current span to a
+// warp10 request, so that a traced warp10 or gateway can join the trace
+func injectTraceContext(ctx context.Context, header http.Header) {
+	propagation.TraceContext{}.Inject(ctx, propagation.HeaderCarrier(header))
+}
@@ -0,0 +1,60 @@
+package plugin
+
+import (
+	"context"
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/grafana/grafana-plugin-sdk-go/backend/tracing"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"net/http"
+	"testing"
+)
+
+func TestQueryDataTracing(t *testing.T) {
+	recorder := tracetest.NewSpanRecorder()
+	provider := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder))
+	previous := tracing.DefaultTracer()
+	tracing.InitDefaultTracer(provider.Tracer("test"))
+	defer tracing.InitDefaultTracer(previous)
+
+	var traceparent string
+	d := newTestDatasource(t, func(w http.ResponseWriter, r *http.Request) {
+		traceparent = r.Header.Get("traceparent")
+		_, _ = w.Write([]byte(`[42, [1, 2]]`))
+	})
+
+	_, err := d.QueryData(context.Background(), &backend.QueryDataRequest{
+		Queries: []backend.DataQuery{{RefID: "A", JSON: []byte(`{"expr": "[ 1 2 ] 42"}`)}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	spans := map[string]sdktrace.ReadOnlySpan{}
+	for _, span := range recorder.Ended() {
+		spans[span.Name()] = span
+	}
+
+	for _, name := range []string{"QueryData", "query", "exec", "decode scalar", "decode array"} {
+		if _, ok := spans[name]; !ok {
+			t.Errorf("Expected a %s span", name)
+		}
+	}
+
+	if exec, ok := spans["exec"]; ok {
+		if len(traceparent) < 35 || exec.SpanContext().TraceID().String() != traceparent[3:35] {
+			t.Errorf("Expected the exec trace to be propagated to warp10, got traceparent %q", traceparent)
+		}
+		if query := spans["query"]; query != nil && exec.Parent().SpanID() != query.SpanContext().SpanID() {
+			t.Error("Expected the exec span to be a child of the query span")
+		}
+	}
+
+	if array, ok := spans["decode array"]; ok {
+		for _, attr := range array.Attributes() {
+			if attr.Key == attributeShape && attr.Value.AsString() != shapeArray {
+				t.Errorf("Expected the array shape attribute, got %q", attr.Value.AsString())
+			}
+		}
+	}
+}
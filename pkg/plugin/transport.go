@@ -0,0 +1,85 @@
+package plugin
+
+import (
+	"context"
+	"fmt"
+	"github.com/gorilla/websocket"
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/grafana/grafana-plugin-sdk-go/backend/httpclient"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// newHTTPClient builds the client used for every exec call from Grafana's
+// standard HTTP settings. They are read by the SDK from the datasource:
+//   - jsonData: tlsAuth, tlsAuthWithCACert, tlsSkipVerify, serverName,
+//     dialTimeout, httpKeepAlive, httpTLSHandshakeTimeout, httpMaxConnsPerHost,
+//     httpMaxIdleConns, httpMaxIdleConnsPerHost, httpIdleConnTimeout
+//   - secureJsonData: tlsCACert, tlsClientCert, tlsClientKey
+//
+// The HTTP proxy is the only plugin specific setting, see WarpDataSourceOptions.
+func newHTTPClient(ctx context.Context, ds backend.DataSourceInstanceSettings, jsonData WarpDataSourceOptions) (*http.Client, error) {
+	opts, err := ds.HTTPClientOptions(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("http client options: %w", err)
+	}
+
+	// WarpScript executions are bounded by the datasource query timeout instead,
+	// the SDK default (30s) would silently cut long running scripts
+	opts.Timeouts.Timeout = 0
+
+	if jsonData.HTTPProxy != "" {
+		proxyURL, err := url.Parse(jsonData.HTTPProxy)
+		if err != nil {
+			return nil, fmt.Errorf("http proxy url: %w", err)
+		}
+
+		opts.ConfigureTransport = func(_ httpclient.Options, transport *http.Transport) {
+			transport.Proxy = http.ProxyURL(proxyURL)
+		}
+	}
+
+	return httpclient.New(opts)
+}
+
+// newMobiusDialer builds the dialer of the Mobius WebSocket connections from
+// the same settings as newHTTPClient: TLS, proxy and custom headers.
+func newMobiusDialer(ctx context.Context, ds backend.DataSourceInstanceSettings, jsonData WarpDataSourceOptions) (*mobiusDialer, error) {
+	opts, err := ds.HTTPClientOptions(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("http client options: %w", err)
+	}
+
+	tlsConfig, err := httpclient.GetTLSConfig(opts)
+	if err != nil {
+		return nil, fmt.Errorf("tls config: %w", err)
+	}
+
+	dialer := &websocket.Dialer{
+		Proxy:            http.ProxyFromEnvironment,
+		TLSClientConfig:  tlsConfig,
+		HandshakeTimeout: opts.Timeouts.Timeout,
+	}
+	if jsonData.HTTPProxy != "" {
+		proxyURL, err := url.Parse(jsonData.HTTPProxy)
+		if err != nil {
+			return nil, fmt.Errorf("http proxy url: %w", err)
+		}
+		dialer.Proxy = http.ProxyURL(proxyURL)
+	}
+
+	endpoint, err := url.Parse(jsonData.Path)
+	if err != nil {
+		return nil, fmt.Errorf("mobius url: %w", err)
+	}
+	switch endpoint.Scheme {
+	case "https":
+		endpoint.Scheme = "wss"
+	default:
+		endpoint.Scheme = "ws"
+	}
+	endpoint.Path = strings.TrimSuffix(endpoint.Path, "/") + mobiusPath
+
+	return &mobiusDialer{dialer: dialer, url: endpoint.String(), header: opts.Header, readLimit: maxResponseBytes(jsonData.MaxResponseSize)}, nil
+}
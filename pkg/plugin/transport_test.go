@@ -0,0 +1,72 @@
+package plugin
+
+import (
+	"context"
+	"fmt"
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestNewDatasourceTLSSkipVerify(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("[3]"))
+	}))
+	defer server.Close()
+
+	settings := func(skipVerify bool) backend.DataSourceInstanceSettings {
+		jsonData := fmt.Sprintf(`{"path": %q, "tlsSkipVerify": %t}`, server.URL, skipVerify)
+		return backend.DataSourceInstanceSettings{JSONData: []byte(jsonData)}
+	}
+
+	// self signed certificate must be rejected by default
+	instance, err := NewDatasource(context.Background(), settings(false))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := instance.(*Datasource).exec(context.Background(), "1 2 +", discardBody); err == nil {
+		t.Error("Expected self signed certificate to be rejected")
+	}
+
+	instance, err = NewDatasource(context.Background(), settings(true))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := instance.(*Datasource).exec(context.Background(), "1 2 +", discardBody); err != nil {
+		t.Errorf("Expected tlsSkipVerify to accept the certificate, got %v", err)
+	}
+}
+
+func TestNewDatasourceInvalidCACert(t *testing.T) {
+	_, err := NewDatasource(context.Background(), backend.DataSourceInstanceSettings{
+		JSONData:                []byte(`{"path": "https://localhost", "tlsAuthWithCACert": true}`),
+		DecryptedSecureJSONData: map[string]string{"tlsCACert": "not a certificate"},
+	})
+	if err == nil {
+		t.Error("Expected an invalid CA certificate to be rejected")
+	}
+}
+
+func TestNewDatasourceHTTPProxy(t *testing.T) {
+	proxied := false
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		proxied = r.URL.Host == "warp10.internal:8080"
+		_, _ = w.Write([]byte("[3]"))
+	}))
+	defer proxy.Close()
+
+	instance, err := NewDatasource(context.Background(), backend.DataSourceInstanceSettings{
+		JSONData: []byte(`{"path": "http://warp10.internal:8080", "httpProxy": "` + proxy.URL + `"}`),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := instance.(*Datasource).exec(context.Background(), "1 2 +", discardBody); err != nil {
+		t.Fatal(err)
+	}
+	if !proxied {
+		t.Error("Expected exec request to go through the HTTP proxy")
+	}
+}
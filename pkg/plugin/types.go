@@ -1,14 +1,44 @@
 package plugin
 
-import "time"
+import (
+	"fmt"
+	"time"
+)
 
+// ConstProp is a datasource level constant or macro
 type ConstProp struct {
-	name  string
-	value string
+	Name  string `json:"name"`
+	Value string `json:"value"`
 }
 
 type WarpDataSourceOptions struct {
-	Path string `json:"path"`
+	Path  string      `json:"path"`
+	Const []ConstProp `json:"const"`
+	Macro []ConstProp `json:"macro"`
+	// Name of the WarpScript variable holding the secure token, "token" by default
+	TokenVariable string `json:"tokenVariable"`
+	// Maximum execution time of a query in seconds, no limit when 0
+	QueryTimeout int `json:"queryTimeout"`
+	// Maximum number of queries running at the same time, no limit when 0
+	MaxConcurrentQueries int `json:"maxConcurrentQueries"`
+	// Maximum number of queries started per second, no limit when 0
+	RateLimit float64 `json:"rateLimit"`
+	// Number of queries allowed to start at once above RateLimit
+	RateLimitBurst int `json:"rateLimitBurst"`
+	// URL of the HTTP proxy used to reach warp10, environment proxy when empty
+	HTTPProxy string `json:"httpProxy"`
+	// Send the Grafana user, dashboard and panel as headers of each exec call
+	ForwardGrafanaUser bool `json:"forwardGrafanaUser"`
+	// Prefix of the GTS attributes in the Grafana field labels
+	AttributesPrefix string `json:"attributesPrefix"`
+	// Maximum number of query results kept in memory, no cache when 0
+	CacheSize int `json:"cacheSize"`
+	// Lifetime of a cached result in seconds, 60 when not set
+	CacheTTL int `json:"cacheTTL"`
+	// Step in seconds the cached time ranges are rounded down to, 10 when not set
+	CacheStep int `json:"cacheStep"`
+	// Maximum size of a warp10 response in MB, 512 when not set, no limit when negative
+	MaxResponseSize int `json:"maxResponseSize"`
 }
 
 // GrafanaRequest describe a warp10 request from Grafana
@@ -27,6 +57,20 @@ type WSQuery struct {
 	IntervalMs    int          `json:"intervalMs"`
 	MaxDataPoints int          `json:"maxDataPoints"`
 	HideLabels    bool         `json:"hideLabels"`
+	LegendFormat  string       `json:"legendFormat"`
+	GeoPoints     bool         `json:"geoPoints"`
+	// Stream the new datapoints of the query to Grafana Live
+	Live bool `json:"live"`
+	// Interval of a live query in seconds, 10 when not set
+	LiveInterval int `json:"liveInterval"`
+	// Stream the results of the query executed by warp10 Mobius every LiveInterval
+	Mobius bool `json:"mobius"`
+	// Always execute the query, even when the datasource caches results
+	NoCache bool `json:"noCache"`
+	// Fetch only the new tail of the time range, the previous series being kept by the backend
+	Incremental bool `json:"incremental"`
+	// Number of lines of the header prepended to Expr by the frontend (dashboard variables)
+	HeaderLines int `json:"headerLines"`
 }
 
 type WSDatasource struct {
@@ -52,6 +96,9 @@ type CustomTime struct {
 
 // TableResult is another type of response from warp10 with GTSList
 type TableResult struct {
+	// Optional frame name, title is used when name is not set
+	Name    string `json:"name"`
+	Title   string `json:"title"`
 	Columns []struct {
 		Text string `json:"text"`
 		Type string `json:"type"`
@@ -60,3 +107,34 @@ type TableResult struct {
 	} `json:"columns"`
 	Rows [][]interface{} `json:"rows"`
 }
+
+// FrameMetaCustom is the datasource specific metadata of every frame
+type FrameMetaCustom struct {
+	// Position of the converted value in the warp10 stack, 0 being the top
+	StackDepth int `json:"stackDepth"`
+	// The result was served from the query cache, stored at CachedAt
+	Cached   bool       `json:"cached,omitempty"`
+	CachedAt *time.Time `json:"cachedAt,omitempty"`
+	// Identity of the GTS of the frame, its class and labels, see seriesKey
+	Series string `json:"-"`
+}
+
+// parseOptions drives the conversion of the warp10 stack to frames
+type parseOptions struct {
+	// display GTS with their class name only
+	hideLabels bool
+	// display GTS with this template, see formatLegend
+	legendFormat string
+	// prefix of the GTS attributes in the field labels
+	attributesPrefix string
+	// return located GTS as point lists, without their unlocated datapoints
+	geoPoints bool
+	// records the parsed shapes, nil records nothing
+	metrics *datasourceMetrics
+}
+
+// key identifies the options changing the decoded frames, in the keys of the
+// coalesced executions and of the query cache
+func (o parseOptions) key() string {
+	return fmt.Sprintf("%t %t %q %q", o.hideLabels, o.geoPoints, o.legendFormat, o.attributesPrefix)
+}
@@ -47,7 +47,7 @@ func TestMain(m *testing.M) {
 	}
 	warpPort := port["8080/tcp"][0].HostPort
 	client = b.NewClient(fmt.Sprintf("http://localhost:%v", warpPort))
-	ds = Datasource{client}
+	ds = Datasource{client: client}
 
 	exitVal := m.Run()
 
@@ -91,7 +91,7 @@ func TestTableResultQuery(t *testing.T) {
 	}
 
 	// the value .results.A.frames[0].refId = "A" was removed from shoul be value, Grafana may add it after making a request to proxy
-	responseShouldBe := `{"results":{"A":{"status":200,"frames":[{"schema":{"name":"tableResults","fields":[{"name":"columnA","type":"number","typeInfo":{"frame":"float64","nullable":true}},{"name":"columnB","type":"number","typeInfo":{"frame":"float64","nullable":true}}]},"data":{"values":[[10,100,100,100,100,100,100,100],[20,200,200,200,200,200,200,200]]}}]}}}`
+	responseShouldBe := `{"results":{"A":{"status":200,"frames":[{"schema":{"name":"tableResults","meta":{"typeVersion":[0,0],"custom":{"stackDepth":0}},"fields":[{"name":"columnA","type":"number","typeInfo":{"frame":"float64","nullable":true}},{"name":"columnB","type":"number","typeInfo":{"frame":"float64","nullable":true}}]},"data":{"values":[[10,100,100,100,100,100,100,100],[20,200,200,200,200,200,200,200]]}}]}}}`
 	jsonResponse, err := queryDataRes.MarshalJSON()
 
 	if err != nil {
@@ -137,7 +137,7 @@ func TestGTSListQuery(t *testing.T) {
 	}
 
 	// the value .results.A.frames[0].refId = "A" was removed from responseShouldBe value, Grafana may add it after making a request to proxy
-	responseShouldBe := `{"results":{"A":{"status":200,"frames":[{"schema":{"fields":[{"name":"time","type":"time","typeInfo":{"frame":"time.Time"}},{"name":"testClass{}","type":"number","typeInfo":{"frame":"float64"}}]},"data":{"values":[[1619784000000,1619784001000],[42.5,43.2]]}}]}}}`
+	responseShouldBe := `{"results":{"A":{"status":200,"frames":[{"schema":{"meta":{"typeVersion":[0,0],"custom":{"stackDepth":0}},"fields":[{"name":"time","type":"time","typeInfo":{"frame":"time.Time"}},{"name":"testClass","type":"number","typeInfo":{"frame":"float64"},"config":{"displayNameFromDS":"testClass{}"}}]},"data":{"values":[[1619784000000,1619784001000],[42.5,43.2]]}}]}}}`
 	jsonResponse, err := queryDataRes.MarshalJSON()
 
 	if err != nil {
@@ -182,7 +182,7 @@ func TestArrayQuery(t *testing.T) {
 	}
 
 	// the value .results.A.frames[0].refId = "A" was removed from shoul be value, Grafana may add it after making a request to proxy
-	responseShouldBe := `{"results":{"A":{"status":200,"frames":[{"schema":{"name":"arrayResults","fields":[{"name":"array_value","type":"number","typeInfo":{"frame":"float64","nullable":true}}]},"data":{"values":[[42.5,43.2,44.1]]}}]}}}`
+	responseShouldBe := `{"results":{"A":{"status":200,"frames":[{"schema":{"name":"arrayResults","meta":{"typeVersion":[0,0],"custom":{"stackDepth":0}},"fields":[{"name":"array_value","type":"number","typeInfo":{"frame":"float64","nullable":true}}]},"data":{"values":[[42.5,43.2,44.1]]}}]}}}`
 	jsonResponse, err := queryDataRes.MarshalJSON()
 
 	if err != nil {
@@ -227,7 +227,7 @@ func TestScalarQuery(t *testing.T) {
 	}
 
 	// the value .results.A.frames[0].refId = "A" was removed from shoul be value, Grafana may add it after making a request to proxy
-	responseShouldBe := `{"results":{"A":{"status":200,"frames":[{"schema":{"name":"scalarResult","fields":[{"name":"scalar_value_float64","type":"number","typeInfo":{"frame":"float64"}}]},"data":{"values":[[42]]}}]}}}`
+	responseShouldBe := `{"results":{"A":{"status":200,"frames":[{"schema":{"name":"scalarResult","meta":{"typeVersion":[0,0],"custom":{"stackDepth":0}},"fields":[{"name":"scalar_value_float64","type":"number","typeInfo":{"frame":"float64"}}]},"data":{"values":[[42]]}}]}}}`
 	jsonResponse, err := queryDataRes.MarshalJSON()
 
 	if err != nil {
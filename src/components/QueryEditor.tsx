@@ -3,7 +3,7 @@ import { QueryEditorProps } from '@grafana/data';
 import { DataSource } from '../datasource';
 import { WarpDataSourceOptions, WarpQuery } from '../types/types';
 import { debounceTime, tap, Subject } from 'rxjs';
-import { TextArea, Button, Checkbox } from '@grafana/ui';
+import { TextArea, Button, Checkbox, Input } from '@grafana/ui';
 
 type Props = QueryEditorProps<DataSource, WarpQuery, WarpDataSourceOptions>;
 
@@ -16,7 +16,7 @@ function nbrLinesText(text: string | undefined) {
 }
 
 export function QueryEditor({ query, onChange, onRunQuery }: Props) {
-  let { expr, hideLabels } = query;
+  let { expr, hideLabels, legendFormat, geoPoints, live, liveInterval, mobius, noCache, incremental } = query;
 
   // fix to make progressive change in Grafana
   // Previous version of these plugin as already be deployed
@@ -63,15 +63,94 @@ export function QueryEditor({ query, onChange, onRunQuery }: Props) {
     onChange({ ...query, hideLabels: event.currentTarget.checked });
   };
 
+  const onLegendFormatChange = (event: React.ChangeEvent<HTMLInputElement>) => {
+    onChange({ ...query, legendFormat: event.currentTarget.value });
+  };
+
+  const onGeoPointsChange = (event: React.ChangeEvent<HTMLInputElement>) => {
+    onChange({ ...query, geoPoints: event.currentTarget.checked });
+  };
+
+  const onLiveChange = (event: React.ChangeEvent<HTMLInputElement>) => {
+    onChange({ ...query, live: event.currentTarget.checked });
+  };
+
+  const onMobiusChange = (event: React.ChangeEvent<HTMLInputElement>) => {
+    onChange({ ...query, mobius: event.currentTarget.checked });
+  };
+
+  const onNoCacheChange = (event: React.ChangeEvent<HTMLInputElement>) => {
+    onChange({ ...query, noCache: event.currentTarget.checked });
+  };
+
+  const onIncrementalChange = (event: React.ChangeEvent<HTMLInputElement>) => {
+    onChange({ ...query, incremental: event.currentTarget.checked });
+  };
+
+  const onLiveIntervalChange = (event: React.ChangeEvent<HTMLInputElement>) => {
+    const value = parseInt(event.currentTarget.value, 10);
+    onChange({ ...query, liveInterval: isNaN(value) ? undefined : value });
+  };
+
   return (
     <div className="gf-form" style={{  display: 'flex', flexDirection: 'column' }}>
       <TextArea rows={nbrLinesText(expr)} value={expr} onChange={onExprChange} onKeyDown={handleRunQueryShortcut} placeholder="Enter your query here (CTRL+ENTER to run)" />
       <div style={{ width: '100%', display: 'flex', justifyContent: 'space-between', alignItems: 'center', marginTop: '8px' }}>
-        <Checkbox 
-          label="Hide labels" 
-          value={hideLabels ?? false} 
-          onChange={onHideLabelsChange}
-        />
+        <div style={{ display: 'flex', alignItems: 'center', gap: '16px' }}>
+          <Checkbox 
+            label="Hide labels" 
+            value={hideLabels ?? false} 
+            onChange={onHideLabelsChange}
+          />
+          <Input
+            width={40}
+            value={legendFormat ?? ''}
+            onChange={onLegendFormatChange}
+            onBlur={onRunQuery}
+            placeholder="Legend, e.g. {{host}} (proxy mode)"
+          />
+          <Checkbox
+            label="Geo points"
+            description="Return located series as point lists (proxy mode)"
+            value={geoPoints ?? false}
+            onChange={onGeoPointsChange}
+          />
+          <Checkbox
+            label="Live"
+            description="Stream the new datapoints of the query (proxy mode)"
+            value={live ?? false}
+            onChange={onLiveChange}
+          />
+          <Checkbox
+            label="Mobius"
+            description="Stream the results of the query executed by Warp 10 Mobius (proxy mode)"
+            value={mobius ?? false}
+            onChange={onMobiusChange}
+          />
+          {(live || mobius) && (
+            <Input
+              width={16}
+              type="number"
+              min={1}
+              value={liveInterval ?? ''}
+              onChange={onLiveIntervalChange}
+              onBlur={onRunQuery}
+              placeholder="Interval (s), 10"
+            />
+          )}
+          <Checkbox
+            label="Bypass cache"
+            description="Always execute the query, even when the datasource caches results (proxy mode)"
+            value={noCache ?? false}
+            onChange={onNoCacheChange}
+          />
+          <Checkbox
+            label="Incremental"
+            description="Only fetch the new datapoints of the time range on refresh, for scripts fetching between $start and $end (proxy mode)"
+            value={incremental ?? false}
+            onChange={onIncrementalChange}
+          />
+        </div>
 
         {/* disabled if expr is empty */}
         <Button variant="primary" style={{ }} onClick={onRunQuery} disabled={(expr ?? '').trim() === ''}>
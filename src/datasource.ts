@@ -56,9 +56,11 @@ export class DataSource extends DataSourceWithBackend<WarpQuery, WarpDataSourceO
    * as expected
    * */
   applyTemplateVariables(query: WarpQuery, _scopedVars: ScopedVars): WarpQuery {
-    let header =  this.computeTimeVars(this.request) +
+    // in proxy mode, time variables, constants and macros are injected by the Go backend
+    const direct = this.access === 'direct';
+    let header = (direct ? this.computeTimeVars(this.request) : '') +
       this.addDashboardVariables() +
-      this.computeGrafanaContext() +
+      (direct ? this.computeGrafanaContext() : '') +
       this.computePanelRepeatVars(_scopedVars);
 
     let script = header + query.expr;
@@ -66,6 +68,7 @@ export class DataSource extends DataSourceWithBackend<WarpQuery, WarpDataSourceO
     return {
       ...query,
       expr: script,
+      headerLines: (query.headerLines ?? 0) + countLines(header),
     };
   }
 
@@ -127,6 +130,13 @@ export class DataSource extends DataSourceWithBackend<WarpQuery, WarpDataSourceO
         expr: request.targets[0].expr,
         refId: request.targets[0].refId,
         hideLabels: request.targets[0]?.hideLabels ?? request.targets[0]?.hideLabels,
+        legendFormat: request.targets[0]?.legendFormat,
+        geoPoints: request.targets[0]?.geoPoints,
+        live: request.targets[0]?.live,
+        liveInterval: request.targets[0]?.liveInterval,
+        mobius: request.targets[0]?.mobius,
+        noCache: request.targets[0]?.noCache,
+        incremental: request.targets[0]?.incremental,
       };
       request.targets[0] = this.applyTemplateVariables(query, request.scopedVars);
     }
@@ -391,67 +401,22 @@ export class DataSource extends DataSourceWithBackend<WarpQuery, WarpDataSourceO
    * @param options
    */
   async metricFindQuery(query: string, options?: any): Promise<MetricFindValue[]> {
+    const header = this.addDashboardVariables() + (this.access === 'direct' ? this.computeGrafanaContext() : '');
     let warpQuery: WarpQuery = {
       refId: '',
-      expr: this.addDashboardVariables() + this.computeGrafanaContext() + query,
+      expr: header + query,
       hideLabels: false,
+      headerLines: countLines(header),
     };
 
     if (this.access === 'proxy') {
-      const query = this.query({
-        targets: [warpQuery],
-        scopedVars: {},
-        range: {
-          from: new Date(),
-          to: new Date(Date.now() + 3600 * 1000),
-          raw: {
-            from: new Date(),
-            to: new Date(Date.now() + 3600 * 1000),
-          },
-        },
-      } as unknown as DataQueryRequest<WarpQuery>).pipe(
-        map((value) => {
-          return value?.data.flatMap((frame) => {
-            return frame.fields.flatMap((field: any) => {
-              if (field.values) {
-                const elt = field.values;
-
-                if (field.name.includes('array_value')) {
-                  // simple array response, defined in backend
-                  // (we cannot differentiate variable query from panels' requests)
-                  if (elt.buffer !== undefined) {
-                    return elt.buffer.map((v: any) => ({ text: v }));
-                  } else {
-                    return elt.map((v: any) => ({ text: v }));
-                  }
-                } else if (isArray(elt)) {
-                  return elt.map((v) => ({
-                    text: v.toString(),
-                    value: v.toString(),
-                  }));
-                } else if (isObject(elt)) {
-                  return Object.entries(elt).map(([key, value]) => ({
-                    text: key.toString(),
-                    value: value.toString(),
-                  }));
-                } else {
-                  return [
-                    {
-                      text: elt.toString(),
-                      value: elt.toString(),
-                    },
-                  ];
-                }
-              } else {
-                return [];
-              }
-            });
-          });
-        })
-      );
-
-      const res: MetricFindValue[] = await lastValueFrom(query);
-      return res;
+      // the backend runs the script with its header and converts the stack, see pkg/plugin/resources.go
+      return this.postResource<MetricFindValue[]>('variables', {
+        expr: warpQuery.expr,
+        headerLines: warpQuery.headerLines,
+        from: options?.range?.from?.valueOf(),
+        to: options?.range?.to?.valueOf(),
+      });
     }
 
     // Grafana can handle different text/value for the variable drop list. User has three possibilites in the WarpScript result:
@@ -488,3 +453,8 @@ export class DataSource extends DataSourceWithBackend<WarpQuery, WarpDataSourceO
     );
   }
 }
+
+// countLines returns the number of lines of a WarpScript header, each one ending with a newline
+function countLines(header: string): number {
+  return header.split('\n').length - 1;
+}
@@ -4,6 +4,15 @@ import { DataQuery } from '@grafana/schema';
 export interface WarpQuery extends DataQuery {
   expr: string;
   hideLabels: boolean
+  legendFormat?: string;
+  geoPoints?: boolean;
+  live?: boolean;
+  liveInterval?: number;
+  mobius?: boolean;
+  noCache?: boolean;
+  incremental?: boolean;
+  // lines prepended to expr by applyTemplateVariables, so that the backend reports errors at the editor line
+  headerLines?: number;
 }
 
 export interface ConstProp {
@@ -18,13 +27,36 @@ export interface WarpDataSourceOptions extends DataSourceJsonData {
   path?: string;
   const?: ConstProp[];
   macro?: ConstProp[];
+  tokenVariable?: string;
+  queryTimeout?: number;
+  maxConcurrentQueries?: number;
+  rateLimit?: number;
+  rateLimitBurst?: number;
+  cacheSize?: number;
+  cacheTTL?: number;
+  cacheStep?: number;
+  maxResponseSize?: number;
+  httpProxy?: string;
+  tlsAuth?: boolean;
+  tlsAuthWithCACert?: boolean;
+  tlsSkipVerify?: boolean;
+  serverName?: string;
+  forwardGrafanaUser?: boolean;
+  attributesPrefix?: string;
+  // custom headers, Grafana standard httpHeaderName<N> keys
+  [httpHeaderName: `httpHeaderName${number}`]: string;
 }
 
 /**
  * Value that is used in the backend, but never sent over HTTP to the frontend
  */
 export interface MySecureJsonData {
-  apiKey?: string;
+  token?: string;
+  tlsCACert?: string;
+  tlsClientCert?: string;
+  tlsClientKey?: string;
+  // custom headers, Grafana standard httpHeaderValue<N> keys
+  [httpHeaderValue: `httpHeaderValue${number}`]: string;
 }
 
 /**